@@ -6,23 +6,31 @@ import (
 	"time"
 )
 
+const MAINTENANCE_INTERVAL = 10 * time.Minute
+
 type BackgroundTask struct {
 	ctx                context.Context
 	cancel             context.CancelFunc
 	api                *FNDFrigateApi
 	conf               *FNDConfiguration
 	notify             *FNDNotificationManager
+	history            *FNDHistoryStore
+	outbox             *FNDOutbox
 	configuration_path string
 }
 
 func RunBackgroundTask(api *FNDFrigateApi,
 	conf *FNDConfiguration,
 	notify *FNDNotificationManager,
+	history *FNDHistoryStore,
+	outbox *FNDOutbox,
 	configuration_path string) *BackgroundTask {
 	bg := BackgroundTask{
 		api:                api,
 		conf:               conf,
 		notify:             notify,
+		history:            history,
+		outbox:             outbox,
 		configuration_path: configuration_path,
 	}
 
@@ -36,14 +44,27 @@ func RunBackgroundTask(api *FNDFrigateApi,
 func (bg *BackgroundTask) task() {
 	ticker := time.NewTicker(10 * time.Second)
 	tickerLong := time.NewTicker(120 * time.Minute)
+	tickerMaintenance := time.NewTicker(MAINTENANCE_INTERVAL)
 	defer ticker.Stop()
 	defer tickerLong.Stop()
+	defer tickerMaintenance.Stop()
 
 	for {
 		select {
 		case <-bg.ctx.Done():
 			return
 		case <-ticker.C:
+			err := bg.history.flush()
+			if err != nil {
+				LogError("Error writing event history: %v", err)
+			}
+
+			bg.notify.retryOutbox()
+			err = bg.outbox.flush()
+			if err != nil {
+				LogError("Error writing outbox: %v", err)
+			}
+
 			cams, err := bg.api.getCameras()
 			if err != nil {
 				continue
@@ -51,6 +72,8 @@ func (bg *BackgroundTask) task() {
 			for k := range cams.Cameras {
 				_ = bg.conf.Frigate.checkOrAddCamera(k)
 			}
+		case <-tickerMaintenance.C:
+			bg.notify.maintainAll()
 		case <-tickerLong.C:
 			bg.conf.Notify = bg.notify.getConfigAll()
 			err := bg.conf.WriteToFile(bg.configuration_path)
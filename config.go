@@ -3,13 +3,17 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
+	"strings"
 	"sync"
 )
 
 type FNDConfiguration struct {
 	Frigate FNDFrigateConfiguration
 	Notify  FNDNotificationConfiguration
+	History FNDHistoryConfiguration
+	Outbox  FNDOutboxConfiguration
 }
 
 type FNDFrigateConfiguration struct {
@@ -20,6 +24,11 @@ type FNDFrigateConfiguration struct {
 	Cooldown   int
 	Cameras    map[string]CameraConfig
 	Language   string
+	// Frigate as reachable from browsers and phones, defaults to http://Host:Port
+	ExternalURL string
+	// text/template for notifications, empty means default
+	CaptionTemplate string
+	TitleTemplate   string
 
 	m sync.Mutex
 }
@@ -27,6 +36,20 @@ type FNDFrigateConfiguration struct {
 type CameraConfig struct {
 	Name   string
 	Active bool
+	// overrides FNDFrigateConfiguration.CaptionTemplate/TitleTemplate if set
+	CaptionTemplate string
+	TitleTemplate   string
+}
+
+// Retention limits of the event history, 0 means unlimited
+type FNDHistoryConfiguration struct {
+	MaxEntries int
+	MaxAgeDays int
+}
+
+// Failed deliveries are retried until they are MaxAgeHours old, see notify_outbox.go
+type FNDOutboxConfiguration struct {
+	MaxAgeHours int
 }
 
 type FNDNotificationConfigurationMap struct {
@@ -35,6 +58,10 @@ type FNDNotificationConfigurationMap struct {
 
 type FNDNotificationConfiguration struct {
 	Conf map[string]FNDNotificationConfigurationMap
+	// like "home" or "away", routing rules can depend on it
+	Mode string
+	// without a matching rule every sink gets the notification, see notify_routing.go
+	Rules []FNDRoutingRule
 }
 
 func LoadFNDConf(filename string) *FNDConfiguration {
@@ -59,6 +86,13 @@ func NEWDefaultFNDConfiguration() *FNDConfiguration {
 		},
 		Notify: FNDNotificationConfiguration{
 			Conf: make(map[string]FNDNotificationConfigurationMap),
+		},
+		History: FNDHistoryConfiguration{
+			MaxEntries: 1000,
+			MaxAgeDays: 30,
+		},
+		Outbox: FNDOutboxConfiguration{
+			MaxAgeHours: 24,
 		}}
 }
 
@@ -68,6 +102,14 @@ func NEWDefaultFNDNotificationConfigurationMap() FNDNotificationConfigurationMap
 	}
 }
 
+func (c FNDNotificationConfigurationMap) clone() FNDNotificationConfigurationMap {
+	return FNDNotificationConfigurationMap{Map: maps.Clone(c.Map)}
+}
+
+func (c FNDNotificationConfigurationMap) enabled() bool {
+	return c.Map["enabled"] == "true"
+}
+
 func NewFNDConfigurationFromFile(filename string) (*FNDConfiguration, error) {
 	conf := NEWDefaultFNDConfiguration()
 	_, err := os.Stat(filename)
@@ -100,6 +142,13 @@ func (conf *FNDConfiguration) WriteToFile(filename string) error {
 	return nil
 }
 
+func (fConf *FNDFrigateConfiguration) frigateURL() string {
+	if fConf.ExternalURL != "" {
+		return strings.TrimSuffix(fConf.ExternalURL, "/")
+	}
+	return "http://" + fConf.Host + ":" + fConf.Port
+}
+
 // If the Camera doesnt exists, add a Default one and return that
 func (fConf *FNDFrigateConfiguration) checkOrAddCamera(name string) CameraConfig {
 	fConf.m.Lock()
@@ -118,6 +167,19 @@ func (fConf *FNDFrigateConfiguration) checkOrAddCamera(name string) CameraConfig
 	return cam
 }
 
+func (fConf *FNDFrigateConfiguration) setCameraTemplates(name string, caption string, title string) {
+	fConf.m.Lock()
+	defer fConf.m.Unlock()
+
+	cam, avail := fConf.Cameras[name]
+	if !avail {
+		return
+	}
+	cam.CaptionTemplate = caption
+	cam.TitleTemplate = title
+	fConf.Cameras[name] = cam
+}
+
 func (fConf *FNDFrigateConfiguration) activateCameras(activeList []string) {
 	fConf.m.Lock()
 	defer fConf.m.Unlock()
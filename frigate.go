@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -11,6 +13,8 @@ import (
 const (
 	QOS      = 1
 	CLIENTID = "fnd_sub_v1"
+
+	MQTT_PUBLISH_TIMEOUT = 5 * time.Second
 )
 
 type FNDFrigateConnection struct {
@@ -23,31 +27,55 @@ type FNDFrigateConnection struct {
 }
 
 type eventMessage struct {
-	TypeInfo string `json:"type"`
-	Before   struct {
-		Id             string  `json:"id"`
-		Camera         string  `json:"camera"`
-		Label          string  `json:"label"`
-		Top_Score      float32 `json:"top_score"`
-		False_Positive bool    `json:"false_positive"`
-		Score          float32 `json:"score"`
-	} `json:"before"`
-	After struct {
-		Id             string  `json:"id"`
-		Camera         string  `json:"camera"`
-		Label          string  `json:"label"`
-		Top_Score      float32 `json:"top_score"`
-		False_Positive bool    `json:"false_positive"`
-		Score          float32 `json:"score"`
-	} `json:"after"`
+	TypeInfo string    `json:"type"`
+	Before   eventData `json:"before"`
+	After    eventData `json:"after"`
+}
+
+type eventData struct {
+	Id             string  `json:"id"`
+	Camera         string  `json:"camera"`
+	Label          string  `json:"label"`
+	Top_Score      float32 `json:"top_score"`
+	False_Positive bool    `json:"false_positive"`
+	Score          float32 `json:"score"`
+	Start_Time     float64 `json:"start_time"`
+	// null, "name" or ["name", score] depending on the Frigate version
+	Sub_Label     json.RawMessage `json:"sub_label"`
+	Entered_Zones []string        `json:"entered_zones"`
+	Current_Zones []string        `json:"current_zones"`
+}
+
+// Zones the object is in or has been in, on "new" events entered_zones is usually still empty
+func (d eventData) zones() []string {
+	zones := slices.Clone(d.Entered_Zones)
+	for _, zone := range d.Current_Zones {
+		if !slices.Contains(zones, zone) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+func (d eventData) subLabel() string {
+	var name string
+	if json.Unmarshal(d.Sub_Label, &name) == nil {
+		return name
+	}
+
+	var withScore []interface{}
+	if json.Unmarshal(d.Sub_Label, &withScore) == nil && len(withScore) > 0 {
+		name, _ = withScore[0].(string)
+	}
+	return name
 }
 
-func newFrigateConnection(conf *FNDFrigateConfiguration) *FNDFrigateConnection {
+func newFrigateConnection(conf *FNDFrigateConfiguration, history *FNDHistoryStore) *FNDFrigateConnection {
 	con := &FNDFrigateConnection{
 		mqttServerAddress: "tcp://" + conf.MqttServer + ":" + conf.MqttPort,
 		api:               *NewFNDFrigateApi("http://" + conf.Host + ":" + conf.Port),
 	}
-	con.eventManager = *NewFNDFrigateEventManager(&con.api, conf)
+	con.eventManager = *NewFNDFrigateEventManager(&con.api, conf, history)
 	return con
 
 }
@@ -68,9 +96,9 @@ func (o *FNDFrigateConnection) handle(_ mqtt.Client, msg mqtt.Message) {
 
 }
 
-func setupFNDFrigateConnection(conf *FNDFrigateConfiguration) (*FNDFrigateConnection, error) {
+func setupFNDFrigateConnection(conf *FNDFrigateConfiguration, history *FNDHistoryStore) (*FNDFrigateConnection, error) {
 
-	connection := newFrigateConnection(conf)
+	connection := newFrigateConnection(conf, history)
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(connection.mqttServerAddress)
 	opts.SetClientID(CLIENTID)
@@ -98,6 +126,9 @@ func setupFNDFrigateConnection(conf *FNDFrigateConfiguration) (*FNDFrigateConnec
 
 		t := c.Subscribe("frigate/events", QOS, connection.handle)
 
+		// Events that started while we were offline are unknown to the event manager
+		go connection.resyncActiveEvents()
+
 		go func() {
 			_ = t.Wait()
 			if t.Error() != nil {
@@ -126,11 +157,40 @@ func setupFNDFrigateConnection(conf *FNDFrigateConfiguration) (*FNDFrigateConnec
 	return connection, nil
 }
 
+// Asks the Frigate API for all events in progress and hands them to the event manager,
+// so updates and ends of those events can be matched after a reconnect or restart.
+func (connection *FNDFrigateConnection) resyncActiveEvents() {
+	known := connection.eventManager.startResync()
+
+	events, err := connection.api.getInProgressEvents()
+	if err != nil {
+		connection.eventManager.abortResync()
+		LogError("Resync of active events failed: %v", err)
+		return
+	}
+
+	added, removed := connection.eventManager.resyncActiveEvents(events, known)
+	LogInfo("Resynced active events from Frigate API: %d in progress, %d added, %d removed",
+		len(events), added, removed)
+}
+
 func (connection *FNDFrigateConnection) Disconnect() {
 	connection.client.Disconnect(1000)
 	connection.eventManager.shutdown()
 }
 
+// Publishes payload on the broker fnd is subscribed to, waits at most MQTT_PUBLISH_TIMEOUT
+func (connection *FNDFrigateConnection) publish(topic string, retained bool, payload []byte) error {
+	if connection.client == nil || !connection.client.IsConnected() {
+		return errors.New("MQTT is not connected")
+	}
+	t := connection.client.Publish(topic, QOS, retained, payload)
+	if !t.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		return errors.New("MQTT publish to " + topic + " timed out")
+	}
+	return t.Error()
+}
+
 // FNDNotificationSinkStatus hier bissl missbraucht
 func (connection *FNDFrigateConnection) getStatus() FNDNotificationSinkStatus {
 	var s FNDNotificationSinkStatus
@@ -27,6 +27,21 @@ type APICamera struct {
 	AudioDBFS        float64 `json:"audio_dBFS"`
 }
 
+type APIEvent struct {
+	Id            string   `json:"id"`
+	Camera        string   `json:"camera"`
+	Label         string   `json:"label"`
+	TopScore      float32  `json:"top_score"`
+	FalsePositive bool     `json:"false_positive"`
+	StartTime     float64  `json:"start_time"`
+	SubLabel      string   `json:"sub_label"`
+	Zones         []string `json:"zones"`
+	Data          struct {
+		Score    float32 `json:"score"`
+		TopScore float32 `json:"top_score"`
+	} `json:"data"`
+}
+
 type APIStats struct {
 	Cameras map[string]APICamera `json:"cameras"`
 }
@@ -77,3 +92,58 @@ func (api *FNDFrigateApi) getCameras() (APIStats, error) {
 	err = json.Unmarshal(body, &c)
 	return c, nil
 }
+
+// Returns all events Frigate currently considers in progress.
+func (api *FNDFrigateApi) getInProgressEvents() ([]APIEvent, error) {
+	var events []APIEvent
+	eventsURL := api.url + "/api/events?in_progress=1"
+
+	response, err := http.Get(eventsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Statuscode: " + strconv.Itoa(response.StatusCode))
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Converts an API event into the form Frigate uses on MQTT.
+func (ev APIEvent) toEventMessage() eventMessage {
+	// newer Frigate versions only report the top score inside data
+	topScore := ev.Data.TopScore
+	if topScore == 0 {
+		topScore = ev.TopScore
+	}
+
+	subLabel, _ := json.Marshal(ev.SubLabel)
+
+	data := eventData{
+		Id:             ev.Id,
+		Camera:         ev.Camera,
+		Label:          ev.Label,
+		Top_Score:      topScore,
+		False_Positive: ev.FalsePositive,
+		Score:          ev.Data.Score,
+		Start_Time:     ev.StartTime,
+		Sub_Label:      subLabel,
+		Entered_Zones:  ev.Zones,
+	}
+
+	return eventMessage{
+		TypeInfo: "update",
+		Before:   data,
+		After:    data,
+	}
+}
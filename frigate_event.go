@@ -2,10 +2,29 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
 
+const (
+	STEP_CAMERA   = "camera"
+	STEP_COOLDOWN = "cooldown"
+	STEP_SNAPSHOT = "snapshot"
+	STEP_QUEUE    = "queue"
+	STEP_ROUTING  = "routing"
+	STEP_SINK     = "sink"
+)
+
+// One step on the way from a Frigate event to the notification sinks,
+// so it can be explained why (or why not) a notification arrived.
+type FNDDecisionStep struct {
+	Time    time.Time
+	Step    string
+	Passed  bool
+	Message string
+}
+
 type FNDFrigateEventManager struct {
 	api                 *FNDFrigateApi
 	activeEvents        map[string]eventMessage
@@ -13,17 +32,23 @@ type FNDFrigateEventManager struct {
 
 	lastNotificationSent time.Time
 	fConf                *FNDFrigateConfiguration
+	history              *FNDHistoryStore
+
+	// events ended over MQTT while a resync fetches the events in progress, see startResync
+	endedDuringResync map[string]bool
+	resyncs           int
 
 	m sync.Mutex
 }
 
-func NewFNDFrigateEventManager(api *FNDFrigateApi, fConf *FNDFrigateConfiguration) *FNDFrigateEventManager {
+func NewFNDFrigateEventManager(api *FNDFrigateApi, fConf *FNDFrigateConfiguration, history *FNDHistoryStore) *FNDFrigateEventManager {
 	return &FNDFrigateEventManager{
 		api:                  api,
 		activeEvents:         make(map[string]eventMessage),
 		notificationChannel:  make(chan FNDNotification, 100),
 		lastNotificationSent: time.Now(),
 		fConf:                fConf,
+		history:              history,
 	}
 }
 
@@ -37,68 +62,188 @@ func (e *FNDFrigateEventManager) addNewEventMessage(msg eventMessage) error {
 			return errors.New("Unerwartetes NEW Event")
 		}
 		e.activeEvents[msg.Before.Id] = msg
-		var err error
-		if e.shouldSendNotification(msg) {
-			err = e.prepareNotification(msg)
+
+		entry := FNDHistoryEntry{
+			ID:       msg.After.Id,
+			Camera:   msg.After.Camera,
+			Label:    msg.After.Label,
+			Score:    msg.After.Score,
+			Time:     time.Now(),
+			Decision: DECISION_FILTERED,
 		}
+
+		if !e.shouldSendNotification(msg, &entry) {
+			e.history.addEntry(entry)
+			return nil
+		}
+
+		n, err := e.prepareNotification(msg)
 		if err != nil {
+			entry.reject(STEP_SNAPSHOT, "could not fetch snapshot: "+err.Error())
+			e.history.addEntry(entry)
 			return err
 		}
+		entry.addStep(STEP_SNAPSHOT, true, "snapshot fetched")
+
+		// the entry has to exist before the notification manager reports deliveries
+		entry.Decision = DECISION_NOTIFIED
+		e.history.addEntry(entry)
+		err = e.history.saveSnapshot(entry.ID, n.JpegData)
+		if err != nil {
+			LogWarn("Could not save snapshot of %s: %v", entry.ID, err)
+		}
+
+		if e.sendNotification(n) {
+			e.lastNotificationSent = time.Now()
+		}
 	case "update":
 		if !avail {
 			return errors.New("Unerwartetes UPDATE Event")
 		}
 		e.activeEvents[msg.Before.Id] = msg
 	case "end":
+		if e.endedDuringResync != nil {
+			e.endedDuringResync[msg.Before.Id] = true
+		}
 		if !avail {
 			return errors.New("Unerwartetes END Event")
 		}
 		delete(e.activeEvents, msg.Before.Id)
+		e.history.markEnded(msg.Before.Id, time.Now())
 	}
 
 	return nil
 }
 
-func (e *FNDFrigateEventManager) shouldSendNotification(msg eventMessage) bool {
+// Returns the IDs of the active events and records the events ending from now on,
+// so resyncActiveEvents does not add them again. Must be followed by
+// resyncActiveEvents or abortResync.
+func (e *FNDFrigateEventManager) startResync() []string {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.resyncs == 0 {
+		e.endedDuringResync = make(map[string]bool)
+	}
+	e.resyncs++
+
+	ids := make([]string, 0, len(e.activeEvents))
+	for id := range e.activeEvents {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Seeds the active events with the events in progress reported by the Frigate API.
+// Events we already know keep their (newer) MQTT state. Events from known that are
+// no longer in progress ended while we weren't listening and are dropped.
+// Events that ended since startResync are skipped, the API may still have reported them.
+// No notifications are sent for resynced events.
+func (e *FNDFrigateEventManager) resyncActiveEvents(events []APIEvent, known []string) (added int, removed int) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	defer e.stopResync()
+
+	inProgress := make(map[string]bool, len(events))
+	for _, ev := range events {
+		inProgress[ev.Id] = true
+		if _, avail := e.activeEvents[ev.Id]; avail || e.endedDuringResync[ev.Id] {
+			continue
+		}
+		e.activeEvents[ev.Id] = ev.toEventMessage()
+		added++
+	}
+
+	for _, id := range known {
+		if inProgress[id] {
+			continue
+		}
+		if _, avail := e.activeEvents[id]; !avail {
+			continue
+		}
+		delete(e.activeEvents, id)
+		removed++
+	}
+
+	return added, removed
+}
+
+func (e *FNDFrigateEventManager) abortResync() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.stopResync()
+}
+
+// must be called with e.m locked
+func (e *FNDFrigateEventManager) stopResync() {
+	e.resyncs--
+	if e.resyncs == 0 {
+		e.endedDuringResync = nil
+	}
+}
+
+// Returns whether a notification should be sent for msg. Every check is recorded in entry.
+func (e *FNDFrigateEventManager) shouldSendNotification(msg eventMessage, entry *FNDHistoryEntry) bool {
 	if !e.fConf.checkOrAddCamera(msg.Before.Camera).Active {
+		entry.reject(STEP_CAMERA, "camera "+msg.Before.Camera+" is not active")
 		return false
 	}
+	entry.addStep(STEP_CAMERA, true, "camera "+msg.Before.Camera+" is active")
 
 	diff := time.Now().Sub(e.lastNotificationSent)
+	if diff.Seconds() <= float64(e.fConf.Cooldown) {
+		entry.reject(STEP_COOLDOWN, fmt.Sprintf("last notification %.0fs ago, cooldown is %ds",
+			diff.Seconds(), e.fConf.Cooldown))
+		return false
+	}
+	entry.addStep(STEP_COOLDOWN, true, fmt.Sprintf("last notification %.0fs ago, cooldown is %ds",
+		diff.Seconds(), e.fConf.Cooldown))
 
-	return diff.Seconds() > float64(e.fConf.Cooldown)
-
+	return true
 }
 
-func (e *FNDFrigateEventManager) prepareNotification(msg eventMessage) error {
-	//TODO: Translate this
+func (e *FNDFrigateEventManager) prepareNotification(msg eventMessage) (FNDNotification, error) {
+	ev := newFNDNotificationEvent(msg.After.Id, e.fConf.frigateURL())
+	ev.Camera = msg.After.Camera
+	ev.Label = msg.After.Label
+	ev.SubLabel = msg.After.subLabel()
+	ev.Score = msg.After.Score
+	ev.TopScore = msg.After.Top_Score
+	ev.Zones = msg.After.zones()
 
-	n := FNDNotification{
-		Caption: "camera: " + msg.Before.Camera + " object: " + msg.Before.Label,
-		Date:    time.Now().Format("15:04:05 02.01.2006"),
-	}
+	n := e.fConf.newNotification(ev)
 	jpeg, err := e.api.getSnapshotByID(msg.Before.Id)
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	n.JpegData = jpeg
 
-	e.sendNotification(n)
-	e.lastNotificationSent = time.Now()
-
-	return nil
-
+	return n, nil
 }
 
 // Reiht die Benachrichtigung ein. Wird die Schlange zu voll, wird die Benachrichtigung
-// verworfen. Blockiert also nie.
-func (e *FNDFrigateEventManager) sendNotification(n FNDNotification) {
-	if len(e.notificationChannel) == cap(e.notificationChannel) {
-		return
+// verworfen. Blockiert also nie. Das Ergebnis landet im Entscheidungsverlauf.
+// Der Schritt wird vor dem Einreihen eingetragen, sonst könnten die Dienste schneller sein.
+func (e *FNDFrigateEventManager) sendNotification(n FNDNotification) bool {
+	e.history.update(n.ID, func(entry *FNDHistoryEntry) {
+		entry.addStep(STEP_QUEUE, true, fmt.Sprintf("queued (%d/%d)",
+			len(e.notificationChannel)+1, cap(e.notificationChannel)))
+	})
+
+	select {
+	case e.notificationChannel <- n:
+		return true
+	default:
+		e.history.update(n.ID, func(entry *FNDHistoryEntry) {
+			if last := len(entry.Trace) - 1; last >= 0 && entry.Trace[last].Step == STEP_QUEUE {
+				entry.Trace = entry.Trace[:last]
+			}
+			entry.reject(STEP_QUEUE, fmt.Sprintf("notification queue is full (%d), notification dropped",
+				cap(e.notificationChannel)))
+		})
+		return false
 	}
-
-	e.notificationChannel <- n
 }
 
 func (e *FNDFrigateEventManager) shutdown() {
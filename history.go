@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HISTORY_FILE     = "history.json"
+	HISTORY_SNAPSHOT = "snapshots"
+
+	DECISION_NOTIFIED = "notified"
+	DECISION_FILTERED = "filtered"
+	DECISION_TEST     = "test"
+
+	OUTCOME_DELIVERED = "delivered"
+	OUTCOME_FAILED    = "failed"
+
+	HISTORY_DEFAULT_LIMIT = 50
+)
+
+// One Frigate event (or test notification) as fnd has seen it
+type FNDHistoryEntry struct {
+	ID          string
+	Camera      string
+	Label       string
+	Score       float32
+	Time        time.Time
+	EndTime     time.Time
+	Decision    string
+	Reason      string
+	HasSnapshot bool
+	Deliveries  []FNDHistoryDelivery
+	Trace       []FNDDecisionStep
+}
+
+// Decision about a notification with the steps that led to it, as published by sinks
+type FNDNotificationDecision struct {
+	Decision string                        `json:"decision"`
+	Reason   string                        `json:"reason,omitempty"`
+	Trace    []FNDNotificationDecisionStep `json:"trace"`
+}
+
+type FNDNotificationDecisionStep struct {
+	Step    string    `json:"step"`
+	Passed  bool      `json:"passed"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Result of handing a notification to a single sink
+type FNDHistoryDelivery struct {
+	Sink    string
+	Good    bool
+	Message string
+	Time    time.Time
+}
+
+// Empty fields match everything. Outcome is checked against the deliveries
+// to Sink, or against all deliveries if Sink is empty.
+type FNDHistoryQuery struct {
+	Camera   string
+	Label    string
+	Decision string
+	Sink     string
+	Outcome  string
+	From     time.Time
+	To       time.Time
+	Offset   int
+	Limit    int
+}
+
+// Keeps the event history in memory and persists it as JSON in folder.
+// Snapshots are written to folder/snapshots right away, the entries
+// are written by flush (called periodically and on shutdown).
+type FNDHistoryStore struct {
+	folder  string
+	conf    *FNDHistoryConfiguration
+	entries []FNDHistoryEntry // oldest first
+	dirty   bool
+
+	m sync.Mutex
+}
+
+func NewFNDHistoryStore(folder string, conf *FNDHistoryConfiguration) (*FNDHistoryStore, error) {
+	h := &FNDHistoryStore{
+		folder: folder,
+		conf:   conf,
+	}
+
+	err := os.MkdirAll(filepath.Join(folder, HISTORY_SNAPSHOT), 0755)
+	if err != nil {
+		return h, err
+	}
+
+	data, err := os.ReadFile(h.historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+
+	err = json.Unmarshal(data, &h.entries)
+	if err != nil {
+		// keep the broken file for the user, flush would overwrite it
+		h.entries = nil
+		corrupt := h.historyPath() + ".corrupt-" + time.Now().Format("20060102-150405")
+		if rerr := os.Rename(h.historyPath(), corrupt); rerr != nil {
+			return h, fmt.Errorf("%w (could not move it aside: %v)", err, rerr)
+		}
+		return h, fmt.Errorf("%w (moved to %s)", err, corrupt)
+	}
+	return h, nil
+}
+
+func (h *FNDHistoryStore) historyPath() string {
+	return filepath.Join(h.folder, HISTORY_FILE)
+}
+
+func (h *FNDHistoryStore) snapshotPath(id string) string {
+	// IDs come from Frigate or the web UI, never allow them to leave the folder
+	return filepath.Join(h.folder, HISTORY_SNAPSHOT, filepath.Base(id)+".jpg")
+}
+
+// must be called with h.m locked
+func (h *FNDHistoryStore) find(id string) int {
+	// recent entries are the ones getting updated, so search backwards
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *FNDHistoryStore) addEntry(entry FNDHistoryEntry) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if i := h.find(entry.ID); i >= 0 {
+		h.entries[i] = entry
+	} else {
+		h.entries = append(h.entries, entry)
+	}
+	h.dirty = true
+}
+
+// Appends a step to the decision trace and logs it
+func (entry *FNDHistoryEntry) addStep(step string, passed bool, message string) {
+	entry.Trace = append(entry.Trace, FNDDecisionStep{
+		Time:    time.Now(),
+		Step:    step,
+		Passed:  passed,
+		Message: message,
+	})
+
+	result := "passed"
+	if !passed {
+		result = "failed"
+	}
+	LogInfo("Event %s (%s, %s): %s %s: %s", entry.ID, entry.Camera, entry.Label, step, result, message)
+}
+
+// Records a failed step that keeps the notification from being sent
+func (entry *FNDHistoryEntry) reject(step string, message string) {
+	entry.addStep(step, false, message)
+	entry.Decision = DECISION_FILTERED
+	entry.Reason = message
+}
+
+// Calls f with the entry of id, if there is one
+func (h *FNDHistoryStore) update(id string, f func(entry *FNDHistoryEntry)) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	i := h.find(id)
+	if i < 0 {
+		return
+	}
+	f(&h.entries[i])
+	h.dirty = true
+}
+
+func (h *FNDHistoryStore) saveSnapshot(id string, jpeg []byte) error {
+	err := os.WriteFile(h.snapshotPath(id), jpeg, 0644)
+	if err != nil {
+		return err
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	if i := h.find(id); i >= 0 {
+		h.entries[i].HasSnapshot = true
+		h.dirty = true
+	}
+	return nil
+}
+
+func (h *FNDHistoryStore) addDelivery(id string, d FNDHistoryDelivery) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	i := h.find(id)
+	if i < 0 {
+		return
+	}
+	h.entries[i].Deliveries = append(h.entries[i].Deliveries, d)
+	h.dirty = true
+}
+
+func (h *FNDHistoryStore) markEnded(id string, t time.Time) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	i := h.find(id)
+	if i < 0 {
+		return
+	}
+	h.entries[i].EndTime = t
+	h.dirty = true
+}
+
+func (h *FNDHistoryStore) get(id string) (FNDHistoryEntry, bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	i := h.find(id)
+	if i < 0 {
+		return FNDHistoryEntry{}, false
+	}
+	return h.entries[i], true
+}
+
+// Decision and trace of the history entry up to the queue, the deliveries
+// to the sinks are still running while a sink asks and left out
+func notificationDecision(webServer *FNDWebServer, id string) *FNDNotificationDecision {
+	if webServer == nil || webServer.history == nil {
+		return nil
+	}
+	entry, ok := webServer.history.get(id)
+	if !ok {
+		return nil
+	}
+
+	d := &FNDNotificationDecision{
+		Decision: entry.Decision,
+		Reason:   entry.Reason,
+		Trace:    []FNDNotificationDecisionStep{},
+	}
+	for _, step := range entry.Trace {
+		if step.Step == STEP_SINK {
+			continue
+		}
+		d.Trace = append(d.Trace, FNDNotificationDecisionStep{
+			Step:    step.Step,
+			Passed:  step.Passed,
+			Message: step.Message,
+			Time:    step.Time,
+		})
+	}
+	return d
+}
+
+// Returns OUTCOME_FAILED if any delivery to sink failed, OUTCOME_DELIVERED if all
+// succeeded and "" if nothing was delivered to sink. An empty sink means all sinks.
+func (entry FNDHistoryEntry) deliveryOutcome(sink string) string {
+	outcome := ""
+	for _, d := range entry.Deliveries {
+		if sink != "" && d.Sink != sink {
+			continue
+		}
+		if !d.Good {
+			return OUTCOME_FAILED
+		}
+		outcome = OUTCOME_DELIVERED
+	}
+	return outcome
+}
+
+func (q FNDHistoryQuery) matches(entry FNDHistoryEntry) bool {
+	if q.Camera != "" && q.Camera != entry.Camera {
+		return false
+	}
+	if q.Label != "" && q.Label != entry.Label {
+		return false
+	}
+	if q.Decision != "" && q.Decision != entry.Decision {
+		return false
+	}
+	if q.Sink != "" || q.Outcome != "" {
+		outcome := entry.deliveryOutcome(q.Sink)
+		if outcome == "" || (q.Outcome != "" && q.Outcome != outcome) {
+			return false
+		}
+	}
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !entry.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// Returns the matching entries newest first, paginated by Offset and Limit,
+// together with the total number of matches.
+func (h *FNDHistoryStore) query(q FNDHistoryQuery) ([]FNDHistoryEntry, int) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if q.Limit <= 0 {
+		q.Limit = HISTORY_DEFAULT_LIMIT
+	}
+
+	var result []FNDHistoryEntry
+	total := 0
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if !q.matches(h.entries[i]) {
+			continue
+		}
+		if total >= q.Offset && len(result) < q.Limit {
+			result = append(result, h.entries[i])
+		}
+		total++
+	}
+	return result, total
+}
+
+// All cameras, labels and sinks that occur in the history, for filter selections
+func (h *FNDHistoryStore) filterOptions() (cameras []string, labels []string, sinks []string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for _, e := range h.entries {
+		if !slices.Contains(cameras, e.Camera) {
+			cameras = append(cameras, e.Camera)
+		}
+		if !slices.Contains(labels, e.Label) {
+			labels = append(labels, e.Label)
+		}
+		for _, d := range e.Deliveries {
+			if !slices.Contains(sinks, d.Sink) {
+				sinks = append(sinks, d.Sink)
+			}
+		}
+	}
+	slices.Sort(cameras)
+	slices.Sort(labels)
+	slices.Sort(sinks)
+	return cameras, labels, sinks
+}
+
+// Applies the retention limits, must be called with h.m locked
+func (h *FNDHistoryStore) prune() {
+	drop := 0
+	if h.conf.MaxEntries > 0 && len(h.entries) > h.conf.MaxEntries {
+		drop = len(h.entries) - h.conf.MaxEntries
+	}
+	if h.conf.MaxAgeDays > 0 {
+		oldest := time.Now().AddDate(0, 0, -h.conf.MaxAgeDays)
+		for drop < len(h.entries) && h.entries[drop].Time.Before(oldest) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+
+	for _, e := range h.entries[:drop] {
+		if !e.HasSnapshot {
+			continue
+		}
+		err := os.Remove(h.snapshotPath(e.ID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			LogWarn("Could not remove snapshot of %s: %v", e.ID, err)
+		}
+	}
+	h.entries = slices.Delete(h.entries, 0, drop)
+	h.dirty = true
+}
+
+// Applies the retention limits and writes the history to disk if anything changed
+func (h *FNDHistoryStore) flush() error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.prune()
+	if !h.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a truncated history
+	tmp := h.historyPath() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, h.historyPath())
+	if err != nil {
+		return err
+	}
+
+	h.dirty = false
+	return nil
+}
+
+// Parses the query parameters camera, label, decision, sink, outcome,
+// from, to (2006-01-02), offset and limit
+func parseFNDHistoryQuery(c *gin.Context) FNDHistoryQuery {
+	q := FNDHistoryQuery{
+		Camera:   c.Query("camera"),
+		Label:    c.Query("label"),
+		Decision: c.Query("decision"),
+		Sink:     c.Query("sink"),
+		Outcome:  c.Query("outcome"),
+	}
+
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), time.Local); err == nil {
+		q.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), time.Local); err == nil {
+		// the whole day is included
+		q.To = to.AddDate(0, 0, 1)
+	}
+	if offset, err := strconv.Atoi(c.Query("offset")); err == nil && offset > 0 {
+		q.Offset = offset
+	}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		q.Limit = limit
+	}
+	return q
+}
+
+type HistoryTemplatePayload struct {
+	Entries    []FNDHistoryEntry
+	Total      int
+	Query      FNDHistoryQuery
+	From       string
+	To         string
+	Cameras    []string
+	Labels     []string
+	Sinks      []string
+	HasPrev    bool
+	HasNext    bool
+	PrevOffset int
+	NextOffset int
+	// end of the shown range, NextOffset clamped to Total on the last page
+	ShownTo        int
+	TranslatedText []string
+}
+
+type HistoryDetailTemplatePayload struct {
+	Entry          FNDHistoryEntry
+	Score          string
+	ClipURL        string
+	TranslatedText []string
+}
+
+func (h *FNDHistoryStore) generatePayload(webServer *FNDWebServer, tr Translator, q FNDHistoryQuery) HistoryTemplatePayload {
+	if q.Limit <= 0 {
+		q.Limit = HISTORY_DEFAULT_LIMIT
+	}
+
+	pay := HistoryTemplatePayload{
+		Query:      q,
+		HasPrev:    q.Offset > 0,
+		PrevOffset: max(q.Offset-q.Limit, 0),
+		NextOffset: q.Offset + q.Limit,
+		TranslatedText: []string{
+			tr.lookupToken("history"),
+			tr.lookupToken("camera"),
+			tr.lookupToken("object"),
+			tr.lookupToken("time"),
+			tr.lookupToken("from"),
+			tr.lookupToken("to"),
+			tr.lookupToken("decision"),
+			tr.lookupToken("sink"),
+			tr.lookupToken("outcome"),
+			tr.lookupToken("all"),
+			tr.lookupToken("filter"),
+			tr.lookupToken("notified"),
+			tr.lookupToken("filtered"),
+			tr.lookupToken("delivered"),
+			tr.lookupToken("failed"),
+			tr.lookupToken("previous"),
+			tr.lookupToken("next"),
+			tr.lookupToken("no_entries"),
+			tr.lookupToken("details"),
+			tr.lookupToken("reason"),
+		},
+	}
+
+	pay.Entries, pay.Total = h.query(q)
+	pay.HasNext = pay.NextOffset < pay.Total
+	pay.ShownTo = min(pay.NextOffset, pay.Total)
+	pay.Cameras, pay.Labels, pay.Sinks = h.filterOptions()
+
+	if !q.From.IsZero() {
+		pay.From = q.From.Format("2006-01-02")
+	}
+	if !q.To.IsZero() {
+		// To is exclusive, the form shows the last included day
+		pay.To = q.To.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	return pay
+}
+
+func (h *FNDHistoryStore) generateDetailPayload(webServer *FNDWebServer, tr Translator, entry FNDHistoryEntry) HistoryDetailTemplatePayload {
+	pay := HistoryDetailTemplatePayload{
+		Entry: entry,
+		Score: fmt.Sprintf("%.0f%%", entry.Score*100),
+		TranslatedText: []string{
+			tr.lookupToken("back"),
+			tr.lookupToken("camera"),
+			tr.lookupToken("object"),
+			tr.lookupToken("time"),
+			tr.lookupToken("decision"),
+			tr.lookupToken("reason"),
+			tr.lookupToken("deliveries"),
+			tr.lookupToken("sink"),
+			tr.lookupToken("clip"),
+			tr.lookupToken("score"),
+			tr.lookupToken("notified"),
+			tr.lookupToken("filtered"),
+			tr.lookupToken("trace"),
+		},
+	}
+
+	// test notifications have no clip in Frigate
+	if entry.Decision != DECISION_TEST {
+		pay.ClipURL = webServer.frigateConf.frigateURL() + "/api/events/" + entry.ID + "/clip.mp4"
+	}
+
+	return pay
+}
+
+func (h *FNDHistoryStore) registerWebServer(webServer *FNDWebServer) {
+	webServer.r.GET("/htmx/history.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/history.html"))
+		t.Execute(c.Writer, h.generatePayload(webServer, webServer.translatorFor(c), parseFNDHistoryQuery(c)))
+	})
+
+	webServer.r.GET("/htmx/history_detail.html", func(c *gin.Context) {
+		entry, avail := h.get(c.Query("id"))
+		if !avail {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		t := template.Must(template.ParseFS(templateFS, "templates/history_detail.html"))
+		t.Execute(c.Writer, h.generateDetailPayload(webServer, webServer.translatorFor(c), entry))
+	})
+
+	webServer.r.GET("/api/history", func(c *gin.Context) {
+		entries, total := h.query(parseFNDHistoryQuery(c))
+		c.JSON(http.StatusOK, gin.H{
+			"total":   total,
+			"entries": entries,
+		})
+	})
+
+	webServer.r.GET("/api/history/:id", func(c *gin.Context) {
+		entry, avail := h.get(c.Param("id"))
+		if !avail {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, entry)
+	})
+
+	webServer.r.GET("/history/snapshot/:id", func(c *gin.Context) {
+		entry, avail := h.get(c.Param("id"))
+		if !avail || !entry.HasSnapshot {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.File(h.snapshotPath(entry.ID))
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func historyIDs(entries []FNDHistoryEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+// Entries 1 to 6, oldest first, one hour apart starting on 2024-05-17 at 08:00
+func newTestHistory(t *testing.T) *FNDHistoryStore {
+	t.Helper()
+	h, err := NewFNDHistoryStore(t.TempDir(), &FNDHistoryConfiguration{})
+	if err != nil {
+		t.Fatalf("NewFNDHistoryStore failed: %v", err)
+	}
+
+	start := time.Date(2024, 5, 17, 8, 0, 0, 0, time.Local)
+	entries := []FNDHistoryEntry{
+		{Camera: "garden", Label: "person", Decision: DECISION_NOTIFIED, Deliveries: []FNDHistoryDelivery{{Sink: "Telegram", Good: true}}},
+		{Camera: "garden", Label: "cat", Decision: DECISION_FILTERED},
+		{Camera: "door", Label: "person", Decision: DECISION_NOTIFIED, Deliveries: []FNDHistoryDelivery{{Sink: "Telegram", Good: true}, {Sink: "Gotify", Good: false}}},
+		{Camera: "door", Label: "car", Decision: DECISION_NOTIFIED, Deliveries: []FNDHistoryDelivery{{Sink: "Gotify", Good: true}}},
+		{Camera: "garden", Label: "person", Decision: DECISION_TEST, Deliveries: []FNDHistoryDelivery{{Sink: "Telegram", Good: false}}},
+		{Camera: "garden", Label: "person", Decision: DECISION_NOTIFIED, Deliveries: []FNDHistoryDelivery{{Sink: "Telegram", Good: true}}},
+	}
+	for i, e := range entries {
+		e.ID = fmt.Sprint(i + 1)
+		e.Time = start.Add(time.Duration(i) * time.Hour)
+		h.addEntry(e)
+	}
+	return h
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h := newTestHistory(t)
+	day := time.Date(2024, 5, 17, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		q    FNDHistoryQuery
+		want []string
+	}{
+		{name: "everything newest first", want: []string{"6", "5", "4", "3", "2", "1"}},
+		{name: "camera", q: FNDHistoryQuery{Camera: "door"}, want: []string{"4", "3"}},
+		{name: "label", q: FNDHistoryQuery{Label: "person"}, want: []string{"6", "5", "3", "1"}},
+		{name: "camera and label", q: FNDHistoryQuery{Camera: "garden", Label: "person"}, want: []string{"6", "5", "1"}},
+		{name: "decision", q: FNDHistoryQuery{Decision: DECISION_FILTERED}, want: []string{"2"}},
+		{name: "delivered to any sink", q: FNDHistoryQuery{Sink: "Telegram"}, want: []string{"6", "5", "3", "1"}},
+		{name: "failed anywhere", q: FNDHistoryQuery{Outcome: OUTCOME_FAILED}, want: []string{"5", "3"}},
+		{name: "delivered everywhere", q: FNDHistoryQuery{Outcome: OUTCOME_DELIVERED}, want: []string{"6", "4", "1"}},
+		{name: "delivered to sink", q: FNDHistoryQuery{Sink: "Telegram", Outcome: OUTCOME_DELIVERED}, want: []string{"6", "3", "1"}},
+		{name: "failed at sink", q: FNDHistoryQuery{Sink: "Gotify", Outcome: OUTCOME_FAILED}, want: []string{"3"}},
+		{name: "unknown sink", q: FNDHistoryQuery{Sink: "Matrix"}, want: []string{}},
+		{name: "from", q: FNDHistoryQuery{From: day.Add(11 * time.Hour)}, want: []string{"6", "5", "4"}},
+		{name: "to is exclusive", q: FNDHistoryQuery{To: day.Add(10 * time.Hour)}, want: []string{"2", "1"}},
+		{name: "from and to", q: FNDHistoryQuery{From: day.Add(9 * time.Hour), To: day.Add(11 * time.Hour)}, want: []string{"3", "2"}},
+		{name: "other day", q: FNDHistoryQuery{From: day.AddDate(0, 0, 1)}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, total := h.query(tt.q)
+			if got := historyIDs(entries); !slices.Equal(got, tt.want) {
+				t.Errorf("query(%+v) = %v, want %v", tt.q, got, tt.want)
+			}
+			if total != len(tt.want) {
+				t.Errorf("query(%+v) total = %d, want %d", tt.q, total, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestHistoryQueryPagination(t *testing.T) {
+	h := newTestHistory(t)
+
+	tests := []struct {
+		name  string
+		q     FNDHistoryQuery
+		want  []string
+		total int
+		prev  bool
+		next  bool
+		shown int
+	}{
+		{name: "first page", q: FNDHistoryQuery{Limit: 4}, want: []string{"6", "5", "4", "3"}, total: 6, next: true, shown: 4},
+		{name: "last page", q: FNDHistoryQuery{Offset: 4, Limit: 4}, want: []string{"2", "1"}, total: 6, prev: true, shown: 6},
+		{name: "middle page", q: FNDHistoryQuery{Offset: 2, Limit: 2}, want: []string{"4", "3"}, total: 6, prev: true, next: true, shown: 4},
+		{name: "exactly one page", q: FNDHistoryQuery{Limit: 6}, want: []string{"6", "5", "4", "3", "2", "1"}, total: 6, shown: 6},
+		{name: "beyond the end", q: FNDHistoryQuery{Offset: 10, Limit: 4}, want: []string{}, total: 6, prev: true, shown: 6},
+		{name: "default limit", q: FNDHistoryQuery{}, want: []string{"6", "5", "4", "3", "2", "1"}, total: 6, shown: 6},
+		{name: "filtered", q: FNDHistoryQuery{Label: "person", Offset: 1, Limit: 2}, want: []string{"5", "3"}, total: 4, prev: true, next: true, shown: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pay := h.generatePayload(nil, Translator{}, tt.q)
+			if got := historyIDs(pay.Entries); !slices.Equal(got, tt.want) {
+				t.Errorf("page = %v, want %v", got, tt.want)
+			}
+			if pay.Total != tt.total || pay.HasPrev != tt.prev || pay.HasNext != tt.next || pay.ShownTo != tt.shown {
+				t.Errorf("total %d, prev %v, next %v, shown to %d, want %d, %v, %v, %d",
+					pay.Total, pay.HasPrev, pay.HasNext, pay.ShownTo, tt.total, tt.prev, tt.next, tt.shown)
+			}
+		})
+	}
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	day := time.Date(2024, 5, 17, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		query string
+		want  FNDHistoryQuery
+	}{
+		{name: "empty", query: "", want: FNDHistoryQuery{}},
+		{
+			name:  "filters",
+			query: "camera=garden&label=person&decision=notified&sink=Telegram&outcome=failed",
+			want:  FNDHistoryQuery{Camera: "garden", Label: "person", Decision: DECISION_NOTIFIED, Sink: "Telegram", Outcome: OUTCOME_FAILED},
+		},
+		{
+			name:  "to includes the whole day",
+			query: "from=2024-05-17&to=2024-05-17",
+			want:  FNDHistoryQuery{From: day, To: day.AddDate(0, 0, 1)},
+		},
+		{name: "pagination", query: "offset=50&limit=25", want: FNDHistoryQuery{Offset: 50, Limit: 25}},
+		{name: "invalid values", query: "from=yesterday&to=17.05.2024&offset=-1&limit=zero", want: FNDHistoryQuery{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/history?"+tt.query, nil)
+			if got := parseFNDHistoryQuery(c); got != tt.want {
+				t.Errorf("parseFNDHistoryQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
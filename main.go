@@ -50,8 +50,22 @@ func main() {
 
 	// ###################################
 
+	LogInfo("Loading event history...")
+	history, err := NewFNDHistoryStore(CONFIGURATION_FOLDER, &conf.History)
+	if err != nil {
+		LogError("Error loading event history: %v", err)
+		LogWarn("Continuing with an empty history...")
+	}
+
+	LogInfo("Loading outbox...")
+	outbox, err := NewFNDOutbox(CONFIGURATION_FOLDER, &conf.Outbox)
+	if err != nil {
+		LogError("Error loading outbox: %v", err)
+		LogWarn("Continuing with an empty outbox...")
+	}
+
 	LogInfo("Setting up Frigate connection...")
-	connection, err := setupFNDFrigateConnection(&conf.Frigate)
+	connection, err := setupFNDFrigateConnection(&conf.Frigate, history)
 	if err != nil {
 		LogError("Error setting up Frigate connection: %v", err)
 		LogWarn("Continuing without Frigate connection...")
@@ -61,11 +75,11 @@ func main() {
 	LogInfo("Frigate connection setup completed")
 
 	LogInfo("Setting up web routes...")
-	web := setupBasicRoutes("0.0.0.0:7777", &conf.Frigate)
+	web := setupBasicRoutes("0.0.0.0:7777", &conf.Frigate, history)
 	LogInfo("Web routes setup completed")
 
 	LogInfo("Setting up notification manager...")
-	notify := NewFNDNotificationManager(conf.Notify)
+	notify := NewFNDNotificationManager(conf.Notify, history, outbox)
 	notify.setupNotificationSinks(connection.eventManager.notificationChannel, web, connection)
 	LogInfo("Notification manager setup completed")
 
@@ -73,7 +87,7 @@ func main() {
 	go web.run(&connection.eventManager)
 
 	LogInfo("Starting background task...")
-	bg := RunBackgroundTask(&connection.api, conf, notify, configuration_path)
+	bg := RunBackgroundTask(&connection.api, conf, notify, history, outbox, configuration_path)
 	LogInfo("Background task started")
 
 	LogInfo("FND application is running. Press Ctrl+C to stop.")
@@ -90,6 +104,16 @@ func main() {
 	connection.Disconnect()
 	web.stop()
 
+	err = history.flush()
+	if err != nil {
+		LogError("Error writing event history: %v", err)
+	}
+
+	err = outbox.flush()
+	if err != nil {
+		LogError("Error writing outbox: %v", err)
+	}
+
 	conf.Notify = notify.removeAll()
 	err = conf.WriteToFile(configuration_path)
 	if err != nil {
@@ -1,13 +1,77 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
 )
 
 type FNDNotification struct {
+	// ID of the history entry, the Frigate event ID for real events
+	ID       string
 	JpegData []byte
 	Date     string
 	Caption  string
+	Title    string
+
+	// source of Caption and Title, rendered per sink (see forSink)
+	Event           FNDNotificationEvent
+	CaptionTemplate string
+	TitleTemplate   string
+
+	// set by the outbox when a sink failed for some of its targets only,
+	// like some Matrix rooms, the retry goes to these, see FNDFailedTargetsError
+	Targets []string `json:",omitempty"`
+}
+
+// Whether a sink sends to target, all of its targets unless this is a retry of some
+func (n FNDNotification) goesTo(target string) bool {
+	return n.Targets == nil || slices.Contains(n.Targets, target)
+}
+
+// Notification with its decision as JSON for automations and audit trails
+type FNDNotificationRecord struct {
+	ID          string                   `json:"id"`
+	Camera      string                   `json:"camera"`
+	Label       string                   `json:"label"`
+	SubLabel    string                   `json:"sub_label"`
+	Score       float32                  `json:"score"`
+	TopScore    float32                  `json:"top_score"`
+	Zones       []string                 `json:"zones"`
+	Time        time.Time                `json:"time"`
+	Title       string                   `json:"title"`
+	Caption     string                   `json:"caption"`
+	FrigateURL  string                   `json:"frigate_url"`
+	SnapshotURL string                   `json:"snapshot_url"`
+	ClipURL     string                   `json:"clip_url"`
+	Decision    *FNDNotificationDecision `json:"decision,omitempty"`
+}
+
+func newNotificationRecord(webServer *FNDWebServer, n FNDNotification) FNDNotificationRecord {
+	r := FNDNotificationRecord{
+		ID:          n.ID,
+		Camera:      n.Event.Camera,
+		Label:       n.Event.Label,
+		SubLabel:    n.Event.SubLabel,
+		Score:       n.Event.Score,
+		TopScore:    n.Event.TopScore,
+		Zones:       n.Event.Zones,
+		Time:        n.Event.Time,
+		Title:       n.Title,
+		Caption:     n.Caption,
+		FrigateURL:  n.Event.FrigateURL,
+		SnapshotURL: n.Event.SnapshotURL,
+		ClipURL:     n.Event.ClipURL,
+		Decision:    notificationDecision(webServer, n.ID),
+	}
+	if r.Zones == nil {
+		r.Zones = []string{}
+	}
+	return r
 }
 
 type FNDNotificationSink interface {
@@ -21,33 +85,127 @@ type FNDNotificationSink interface {
 	getStatus() FNDNotificationSinkStatus
 }
 
+// Configuration and status of a sink, embedded by every sink. The web server, the
+// workers of the sink and deliveries left behind by the queue use them at the same
+// time. A configuration is never changed once set: forms change a copy, which then
+// replaces it, so a delivery keeps the configuration it started with.
+type FNDSinkState struct {
+	current    FNDNotificationConfigurationMap
+	lastStatus string
+	m          sync.Mutex
+
+	// one form at a time, so two posts do not lose each other's changes
+	update sync.Mutex
+}
+
+func (s *FNDSinkState) getConfiguration() FNDNotificationConfigurationMap {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.current
+}
+
+func (s *FNDSinkState) setConfiguration(conf FNDNotificationConfigurationMap) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.current = conf
+}
+
+// Hands a copy of the configuration to apply, which replaces the configuration unless it fails
+func (s *FNDSinkState) updateConfiguration(apply func(conf FNDNotificationConfigurationMap) error) error {
+	s.update.Lock()
+	defer s.update.Unlock()
+
+	conf := s.getConfiguration().clone()
+	if err := apply(conf); err != nil {
+		return err
+	}
+	s.setConfiguration(conf)
+	return nil
+}
+
+func (s *FNDSinkState) setStatus(msg string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastStatus = msg
+}
+
+func (s *FNDSinkState) statusMessage() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lastStatus
+}
+
+// Optional for sinks with housekeeping like retention, called regularly by the BackgroundTask
+type FNDNotificationSinkMaintenance interface {
+	maintain() error
+}
+
+// Sinks talking to a server over HTTP only accept http and https URLs
+func validateSinkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL must be an http or https URL")
+	}
+	return nil
+}
+
 type FNDNotificationManager struct {
-	conf  FNDNotificationConfiguration
+	conf FNDNotificationConfiguration
+	// by instance name, the first instance of a type is named like the type
 	sinks map[string]FNDNotificationSink
+	// constructors of the sink types that can have additional instances
+	types   map[string]func() FNDNotificationSink
+	workers map[string]*FNDSinkWorker
+	history *FNDHistoryStore
+	outbox  *FNDOutbox
+	// guards sinks, workers and conf, instances are added and deleted from the web interface
+	m sync.Mutex
 
 	//for status
 	web         *FNDWebServer
 	frigateConn *FNDFrigateConnection
 }
 
-func NewFNDNotificationManager(conf FNDNotificationConfiguration) *FNDNotificationManager {
+func NewFNDNotificationManager(conf FNDNotificationConfiguration, history *FNDHistoryStore, outbox *FNDOutbox) *FNDNotificationManager {
 	return &FNDNotificationManager{
-		conf:  conf,
-		sinks: make(map[string]FNDNotificationSink),
+		conf:    conf,
+		sinks:   make(map[string]FNDNotificationSink),
+		types:   make(map[string]func() FNDNotificationSink),
+		workers: make(map[string]*FNDSinkWorker),
+		history: history,
+		outbox:  outbox,
 	}
 
 }
 
 func (m *FNDNotificationManager) setupNotificationSinks(c chan FNDNotification, web *FNDWebServer, frigateConn *FNDFrigateConnection) {
 	m.registerNotificationSinks(&FNDWebNotificationSink{})
-	m.registerNotificationSinks(&FNDTelegramNotificationSink{})
-	m.registerNotificationSinks(&FNDAppriseNotificationSink{})
+	m.registerSinkType(func() FNDNotificationSink { return &FNDTelegramNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDAppriseNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDWebhookNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDNtfyNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDGotifyNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDPushoverNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDEmailNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDMatrixNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDDiscordNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDSlackNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDSignalNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDMqttNotificationSink{conn: frigateConn} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDHomeAssistantNotificationSink{} })
+	m.registerNotificationSinks(&FNDWebPushNotificationSink{})
+	m.registerSinkType(func() FNDNotificationSink { return &FNDArchiveNotificationSink{} })
+	m.registerSinkType(func() FNDNotificationSink { return &FNDExecNotificationSink{} })
 
 	m.web = web
 	m.frigateConn = frigateConn
 	for _, s := range m.sinks {
 		s.registerWebServer(web)
 	}
+	m.registerWebServer(web)
+	m.registerRoutingWebServer(web)
+	m.registerOutboxWebServer(web)
+	m.setupSinkInstances()
 	go m.notificationThread(c)
 	m.getStatusAll()
 }
@@ -67,15 +225,47 @@ func (m *FNDNotificationManager) registerNotificationSinks(sink FNDNotificationS
 	}
 
 	m.sinks[sink.getName()] = sink
+	m.startWorker(sink.getName(), sink)
 
 	fmt.Println("Registered: ", sink.getName())
 }
 
 func (m *FNDNotificationManager) notifyAll(n FNDNotification) {
-	for _, v := range m.sinks {
-		err := v.sendNotification(n)
-		if err != nil {
-			fmt.Println(err.Error())
+	sinks := m.sinkInstances()
+	rule, routed := m.route(n.Event)
+	m.history.update(n.ID, func(entry *FNDHistoryEntry) {
+		switch {
+		case !routed:
+			entry.addStep(STEP_ROUTING, true, "no rule matches, all sinks")
+		case len(rule.Sinks) == 0:
+			entry.addStep(STEP_ROUTING, false, "dropped by rule "+rule.String())
+		default:
+			entry.addStep(STEP_ROUTING, true, "rule "+rule.String())
+		}
+		// instances deleted after the rule was saved
+		for _, name := range rule.Sinks {
+			if _, ok := sinks[name]; !ok {
+				entry.addStep(STEP_ROUTING, false, "unknown sink "+name+" in rule "+rule.String())
+			}
+		}
+	})
+
+	for name := range sinks {
+		if routed && !slices.Contains(rule.Sinks, name) {
+			continue
+		}
+		m.enqueue(name, n)
+	}
+}
+
+func (m *FNDNotificationManager) maintainAll() {
+	for name, v := range m.sinkInstances() {
+		s, ok := v.(FNDNotificationSinkMaintenance)
+		if !ok {
+			continue
+		}
+		if err := s.maintain(); err != nil {
+			LogError("Maintenance of %s failed: %v", name, err)
 		}
 	}
 }
@@ -83,30 +273,44 @@ func (m *FNDNotificationManager) notifyAll(n FNDNotification) {
 func (m *FNDNotificationManager) getStatusAll() {
 
 	m.web.addNotificationSinkStatus(m.frigateConn.getStatus())
-	for _, v := range m.sinks {
-		m.web.addNotificationSinkStatus(v.getStatus())
+	for name, v := range m.sinkInstances() {
+		m.web.addNotificationSinkStatus(m.instanceStatus(name, v))
 	}
 }
 
 func (m *FNDNotificationManager) removeAll() FNDNotificationConfiguration {
-	for _, v := range m.sinks {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for name, v := range m.sinks {
 		conf, err := v.remove()
 		if err != nil {
 			fmt.Println(err.Error())
 			continue
 		}
-		m.conf.Conf[v.getName()] = conf
+		m.conf.Conf[name] = conf
 	}
 
-	return m.conf
+	return m.configCopy()
 }
 
 func (m *FNDNotificationManager) getConfigAll() FNDNotificationConfiguration {
-	for _, v := range m.sinks {
-		m.conf.Conf[v.getName()] = v.getConfiguration()
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for name, v := range m.sinks {
+		m.conf.Conf[name] = v.getConfiguration()
 	}
 
-	return m.conf
+	return m.configCopy()
+}
+
+// Instances and rules may change while the caller writes the copy to disk, m.m must be held
+func (m *FNDNotificationManager) configCopy() FNDNotificationConfiguration {
+	conf := m.conf
+	conf.Conf = maps.Clone(m.conf.Conf)
+	conf.Rules = slices.Clone(m.conf.Rules)
+	return conf
 }
 
 func (m *FNDNotificationManager) notificationThread(c chan FNDNotification) {
@@ -6,15 +6,18 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const APPRISE_TIMEOUT = 30 * time.Second
+
 type FNDAppriseNotificationSink struct {
-	config            FNDNotificationConfigurationMap
-	webServer         *FNDWebServer
-	lastStatusMessage string
+	FNDSinkState
+	webServer *FNDWebServer
 }
 
 type AppriseTemplatePayload struct {
@@ -23,12 +26,14 @@ type AppriseTemplatePayload struct {
 	ShowStatus      bool
 	Color           string
 	StatusMessage   string
+	Templates       SinkTemplatePayload
 	TranslatedText  []string
 }
 
 func (apprise *FNDAppriseNotificationSink) createDefaultConfig() {
-	apprise.config = NEWDefaultFNDNotificationConfigurationMap()
-	apprise.config.Map["enabled"] = "false"
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	apprise.setConfiguration(conf)
 }
 
 func (apprise *FNDAppriseNotificationSink) getName() string {
@@ -37,11 +42,11 @@ func (apprise *FNDAppriseNotificationSink) getName() string {
 
 func (apprise *FNDAppriseNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
 	if avail {
-		apprise.config = conf
+		apprise.setConfiguration(conf)
 	} else {
 		apprise.createDefaultConfig()
 	}
-	apprise.lastStatusMessage = "init"
+	apprise.setStatus("init")
 	return nil
 }
 
@@ -49,38 +54,48 @@ func (apprise *FNDAppriseNotificationSink) registerWebServer(webServer *FNDWebSe
 	apprise.webServer = webServer
 
 	apprise.webServer.r.GET("/htmx/apprise.html", func(c *gin.Context) {
-		t := template.Must(template.ParseFS(templateFS, "templates/apprise.html"))
-		t.Execute(c.Writer, apprise.generatePayload(false))
+		t := template.Must(template.ParseFS(templateFS, "templates/apprise.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, apprise.generatePayload(apprise.webServer.translatorFor(c), false))
 	})
 
 	apprise.webServer.r.POST("/htmx/apprise.html", func(c *gin.Context) {
-		apprise.config.Map["enabled"] = "false"
 		c.MultipartForm()
-		for key, value := range c.Request.PostForm {
-			if key == "appriseConfigID" {
-				if value[0] == "" {
+		templateErr := apprise.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			conf.Map["enabled"] = "false"
+			for key, value := range c.Request.PostForm {
+				if key == "appriseConfigID" {
+					if value[0] == "" {
+						continue
+					}
+					conf.Map["configID"] = value[0]
 					continue
 				}
-				apprise.config.Map["configID"] = value[0]
-				continue
-			}
-			if key == "aktiv" {
-				if value[0] == "" {
+				if key == "aktiv" {
+					if value[0] == "" {
+						continue
+					}
+					conf.Map["enabled"] = "true"
 					continue
 				}
-				apprise.config.Map["enabled"] = "true"
-				continue
 			}
+			return applyTemplateForm(c, conf, apprise.webServer.translation)
+		})
+
+		pay := apprise.generatePayload(apprise.webServer.translatorFor(c), true)
+		if templateErr != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = templateErr.Error()
 		}
 
-		t := template.Must(template.ParseFS(templateFS, "templates/apprise.html"))
-		t.Execute(c.Writer, apprise.generatePayload(true))
+		t := template.Must(template.ParseFS(templateFS, "templates/apprise.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
 	})
 
 }
 
-func (apprise *FNDAppriseNotificationSink) generatePayload(postReq bool) AppriseTemplatePayload {
-	en, _ := apprise.config.Map["enabled"]
+func (apprise *FNDAppriseNotificationSink) generatePayload(tr Translator, postReq bool) AppriseTemplatePayload {
+	conf := apprise.getConfiguration()
+	en, _ := conf.Map["enabled"]
 	var en_bool bool
 	if en == "" || en == "false" {
 		en_bool = false
@@ -90,12 +105,13 @@ func (apprise *FNDAppriseNotificationSink) generatePayload(postReq bool) Apprise
 
 	pay := AppriseTemplatePayload{
 		Active:          en_bool,
-		AppriseConfigID: apprise.config.Map["configID"],
+		AppriseConfigID: conf.Map["configID"],
+		Templates:       generateSinkTemplatePayload(apprise.webServer, tr, conf, postReq),
 		TranslatedText: []string{
-			apprise.webServer.translation.lookupToken("active"),
-			apprise.webServer.translation.lookupToken("confID"),
-			apprise.webServer.translation.lookupToken("apprise_doc"),
-			apprise.webServer.translation.lookupToken("apply"),
+			tr.lookupToken("active"),
+			tr.lookupToken("confID"),
+			tr.lookupToken("apprise_doc"),
+			tr.lookupToken("apply"),
 		},
 	}
 
@@ -111,22 +127,28 @@ func (apprise *FNDAppriseNotificationSink) generatePayload(postReq bool) Apprise
 }
 
 func (apprise *FNDAppriseNotificationSink) sendNotification(n FNDNotification) error {
-	if apprise.config.Map["enabled"] != "true" {
-		apprise.lastStatusMessage = "disabled"
+	conf := apprise.getConfiguration()
+	if conf.Map["enabled"] != "true" {
+		apprise.setStatus("disabled")
 		return nil
 	}
-	if apprise.config.Map["configID"] == "" {
-		apprise.lastStatusMessage = "Configuration ID is empty!"
+	if conf.Map["configID"] == "" {
+		apprise.setStatus("Configuration ID is empty!")
 		return errors.New("Configuration ID is empty!")
 	}
 
 	//TODO: make this configurable
-	url := "http://apprise:8000/notify/" + apprise.config.Map["configID"]
+	url := "http://apprise:8000/notify/" + conf.Map["configID"]
 	var requestBody bytes.Buffer
 	var err error
 	writer := multipart.NewWriter(&requestBody)
 
-	err = writer.WriteField("body", n.Caption+"   "+n.Date)
+	err = writer.WriteField("title", n.Title)
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteField("body", n.Caption)
 	if err != nil {
 		return err
 	}
@@ -155,7 +177,7 @@ func (apprise *FNDAppriseNotificationSink) sendNotification(n FNDNotification) e
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: APPRISE_TIMEOUT}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -163,25 +185,22 @@ func (apprise *FNDAppriseNotificationSink) sendNotification(n FNDNotification) e
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		apprise.lastStatusMessage = "Rückgabewert falsch"
-		return nil
+		apprise.setStatus("Rückgabewert falsch")
+		return errors.New("Apprise statuscode: " + strconv.Itoa(resp.StatusCode))
 	}
-	apprise.lastStatusMessage = "Online"
+	apprise.setStatus("Online")
 	return nil
 }
 
 func (apprise *FNDAppriseNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
-	return apprise.config, nil
-}
-
-func (apprise *FNDAppriseNotificationSink) getConfiguration() FNDNotificationConfigurationMap {
-	return apprise.config
+	return apprise.getConfiguration(), nil
 }
 
 func (apprise *FNDAppriseNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := apprise.statusMessage()
 	return FNDNotificationSinkStatus{
 		Name:    apprise.getName(),
-		Good:    apprise.lastStatusMessage == "Online",
-		Message: apprise.lastStatusMessage,
+		Good:    msg == "Online",
+		Message: msg,
 	}
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ARCHIVE_DEFAULT_FOLDER = CONFIGURATION_FOLDER + "/archive"
+	ARCHIVE_DATE_FORMAT    = "2006-01-02"
+)
+
+type FNDArchiveNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+
+	// writing and the retention run in different goroutines
+	m sync.Mutex
+}
+
+type ArchiveTemplatePayload struct {
+	Active         bool
+	Folder         string
+	MaxAgeDays     string
+	MaxSizeMB      string
+	Usage          string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+// JSON sidecar next to the snapshot
+type ArchiveRecord struct {
+	FNDNotificationRecord
+	Snapshot string    `json:"snapshot,omitempty"`
+	Archived time.Time `json:"archived"`
+}
+
+// Snapshot and sidecar of one notification, they are removed together
+type archiveItem struct {
+	files   []string
+	size    int64
+	modTime time.Time
+}
+
+func (archive *FNDArchiveNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["folder"] = ARCHIVE_DEFAULT_FOLDER
+	conf.Map["max_age_days"] = "0"
+	conf.Map["max_size_mb"] = "0"
+	archive.setConfiguration(conf)
+}
+
+func (archive *FNDArchiveNotificationSink) getName() string {
+	return "Archive"
+}
+
+func (archive *FNDArchiveNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		archive.setConfiguration(conf)
+	} else {
+		archive.createDefaultConfig()
+	}
+	archive.setStatus("init")
+	return nil
+}
+
+func (archive *FNDArchiveNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	archive.webServer = webServer
+
+	archive.webServer.r.GET("/htmx/archive.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/archive.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, archive.generatePayload(archive.webServer.translatorFor(c), false))
+	})
+
+	archive.webServer.r.POST("/htmx/archive.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := archive.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := archive.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, archive.webServer.translation)
+		})
+
+		pay := archive.generatePayload(archive.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/archive.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the archive settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (archive *FNDArchiveNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	folder := strings.TrimSpace(c.PostForm("folder"))
+	maxAge := strings.TrimSpace(c.PostForm("max_age_days"))
+	maxSize := strings.TrimSpace(c.PostForm("max_size_mb"))
+
+	if maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err != nil || n < 0 {
+			return errors.New("Maximum age must be a number of days, 0 keeps everything")
+		}
+	}
+	if maxSize != "" {
+		if n, err := strconv.Atoi(maxSize); err != nil || n < 0 {
+			return errors.New("Maximum size must be a number of MB, 0 means unlimited")
+		}
+	}
+	if folder != "" {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			return err
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if folder != "" {
+		conf.Map["folder"] = filepath.Clean(folder)
+	}
+	if maxAge != "" {
+		conf.Map["max_age_days"] = maxAge
+	}
+	if maxSize != "" {
+		conf.Map["max_size_mb"] = maxSize
+	}
+	return nil
+}
+
+func (archive *FNDArchiveNotificationSink) generatePayload(tr Translator, postReq bool) ArchiveTemplatePayload {
+	conf := archive.getConfiguration()
+	pay := ArchiveTemplatePayload{
+		Active:     conf.enabled(),
+		Folder:     conf.Map["folder"],
+		MaxAgeDays: strconv.Itoa(archive.intOption("max_age_days")),
+		MaxSizeMB:  strconv.Itoa(archive.intOption("max_size_mb")),
+		Templates:  generateSinkTemplatePayload(archive.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("archive_doc"),
+			tr.lookupToken("folder"),
+			tr.lookupToken("max_age_days"),
+			tr.lookupToken("max_size_mb"),
+			tr.lookupToken("archive_usage"),
+		},
+	}
+
+	if items, err := archive.items(); err == nil {
+		var size int64
+		for _, item := range items {
+			size += item.size
+		}
+		pay.Usage = strconv.Itoa(len(items)) + " / " + strconv.FormatFloat(float64(size)/(1<<20), 'f', 1, 64) + " MB"
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (archive *FNDArchiveNotificationSink) intOption(key string) int {
+	conf := archive.getConfiguration()
+	n, err := strconv.Atoi(conf.Map[key])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func (archive *FNDArchiveNotificationSink) folder() string {
+	conf := archive.getConfiguration()
+	if folder := conf.Map["folder"]; folder != "" {
+		return folder
+	}
+	return ARCHIVE_DEFAULT_FOLDER
+}
+
+// Camera names and IDs become path elements, they must not leave their folder
+func archivePathElement(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// Writes the snapshot and the sidecar to folder/camera/date/time_id.{jpg,json}
+func (archive *FNDArchiveNotificationSink) sendNotification(n FNDNotification) error {
+	conf := archive.getConfiguration()
+	archive.m.Lock()
+	defer archive.m.Unlock()
+
+	if !conf.enabled() {
+		archive.setStatus("disabled")
+		return nil
+	}
+
+	t := n.Event.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	dir := filepath.Join(archive.folder(), archivePathElement(n.Event.Camera), t.Format(ARCHIVE_DATE_FORMAT))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		archive.setStatus(err.Error())
+		return err
+	}
+	base := t.Format("150405") + "_" + archivePathElement(n.ID)
+
+	record := ArchiveRecord{
+		FNDNotificationRecord: newNotificationRecord(archive.webServer, n),
+		Archived:              time.Now(),
+	}
+	if len(n.JpegData) > 0 {
+		record.Snapshot = base + ".jpg"
+		if err := os.WriteFile(filepath.Join(dir, record.Snapshot), n.JpegData, 0644); err != nil {
+			archive.setStatus(err.Error())
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, base+".json"), data, 0644); err != nil {
+		archive.setStatus(err.Error())
+		return err
+	}
+	archive.setStatus("Online")
+	return nil
+}
+
+// Collects the archived notifications, oldest first. Only files in the
+// camera/date folders are considered, anything else in folder is left alone.
+func (archive *FNDArchiveNotificationSink) items() ([]*archiveItem, error) {
+	root := archive.folder()
+	byBase := make(map[string]*archiveItem)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if d.IsDir() {
+			// root, camera, date
+			if rel != "." && len(parts) > 2 {
+				return filepath.SkipDir
+			}
+			if len(parts) == 2 {
+				if _, err := time.Parse(ARCHIVE_DATE_FORMAT, parts[1]); err != nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if len(parts) != 3 || (ext != ".jpg" && ext != ".json") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		base := strings.TrimSuffix(path, ext)
+		item, ok := byBase[base]
+		if !ok {
+			item = &archiveItem{}
+			byBase[base] = item
+		}
+		item.files = append(item.files, path)
+		item.size += info.Size()
+		if info.ModTime().After(item.modTime) {
+			item.modTime = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*archiveItem, 0, len(byBase))
+	for _, item := range byBase {
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b *archiveItem) int { return a.modTime.Compare(b.modTime) })
+	return items, nil
+}
+
+// Retention: removes notifications older than max_age_days, then the oldest
+// ones until the archive is smaller than max_size_mb, and empty folders
+func (archive *FNDArchiveNotificationSink) maintain() error {
+	archive.m.Lock()
+	defer archive.m.Unlock()
+
+	maxAge := archive.intOption("max_age_days")
+	maxSize := int64(archive.intOption("max_size_mb")) << 20
+	if maxAge == 0 && maxSize == 0 {
+		return nil
+	}
+
+	items, err := archive.items()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, item := range items {
+		total += item.size
+	}
+	oldest := time.Now().AddDate(0, 0, -maxAge)
+
+	removed := 0
+	dateDirs := make(map[string]bool)
+	for _, item := range items {
+		tooOld := maxAge > 0 && item.modTime.Before(oldest)
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		for _, file := range item.files {
+			if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				LogWarn("Could not remove archived file %s: %v", file, err)
+			}
+			dateDirs[filepath.Dir(file)] = true
+		}
+		total -= item.size
+		removed++
+	}
+
+	if removed > 0 {
+		removeEmptyFolders(dateDirs)
+		LogInfo("Archive retention removed %d notifications", removed)
+	}
+	return nil
+}
+
+// Removes the date folders retention emptied and then their camera folders,
+// if nothing else is left in them. Other empty folders are left alone.
+func removeEmptyFolders(dateDirs map[string]bool) {
+	for dateDir := range dateDirs {
+		// fails for folders that still contain files
+		if os.Remove(dateDir) == nil {
+			os.Remove(filepath.Dir(dateDir))
+		}
+	}
+}
+
+func (archive *FNDArchiveNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return archive.getConfiguration(), nil
+}
+
+func (archive *FNDArchiveNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := archive.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    archive.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
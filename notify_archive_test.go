@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestArchivePathElement(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "garden", want: "garden"},
+		{in: "1716000000.1-abc", want: "1716000000.1-abc"},
+		{in: "../etc", want: ".._etc"},
+		{in: `a\b:c/d`, want: "a_b_c_d"},
+		{in: "", want: "_"},
+		{in: ".", want: "_"},
+		{in: "..", want: "_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := archivePathElement(tt.in); got != tt.want {
+				t.Errorf("archivePathElement(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// Archived notification in root/camera/date/base.{jpg,json}, size bytes in the
+// snapshot and last written age ago
+type testArchived struct {
+	camera string
+	base   string
+	size   int64
+	age    time.Duration
+}
+
+func (a testArchived) dir(root string) string {
+	return filepath.Join(root, a.camera, time.Now().Add(-a.age).Format(ARCHIVE_DATE_FORMAT))
+}
+
+func writeTestArchive(t *testing.T, root string, archived []testArchived) {
+	t.Helper()
+	for _, a := range archived {
+		dir := a.dir(root)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-a.age)
+		for _, file := range []string{a.base + ".jpg", a.base + ".json"} {
+			path := filepath.Join(dir, file)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Ext(file) == ".jpg" {
+				err = f.Truncate(a.size)
+			}
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func newTestArchive(t *testing.T, root string, maxAgeDays int, maxSizeMB int) *FNDArchiveNotificationSink {
+	t.Helper()
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "true"
+	conf.Map["folder"] = root
+	conf.Map["max_age_days"] = strconv.Itoa(maxAgeDays)
+	conf.Map["max_size_mb"] = strconv.Itoa(maxSizeMB)
+	archive := &FNDArchiveNotificationSink{}
+	archive.setup(conf, true)
+	return archive
+}
+
+func TestArchiveItems(t *testing.T) {
+	root := t.TempDir()
+	writeTestArchive(t, root, []testArchived{
+		{camera: "garden", base: "120000_new", size: 10, age: time.Hour},
+		{camera: "door", base: "120000_old", size: 20, age: 50 * time.Hour},
+	})
+	// anything else in the folder is not part of the archive
+	for _, path := range []string{"notes.jpg", "garden/notes.jpg", "garden/photos/a.jpg", "garden/" + time.Now().Format(ARCHIVE_DATE_FORMAT) + "/notes.txt"} {
+		path = filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := newTestArchive(t, root, 0, 0).items()
+	if err != nil {
+		t.Fatalf("items failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("items found %d notifications, want 2", len(items))
+	}
+	if len(items[0].files) != 2 || items[0].size != 20 || filepath.Base(filepath.Dir(filepath.Dir(items[0].files[0]))) != "door" {
+		t.Errorf("first item = %+v, want the older one with snapshot and sidecar", items[0])
+	}
+	if items[1].size != 10 {
+		t.Errorf("second item = %+v, want the newer one", items[1])
+	}
+}
+
+func TestArchiveMaintain(t *testing.T) {
+	const mb = 1 << 20
+	archived := []testArchived{
+		{camera: "garden", base: "a", size: mb / 2, age: 100 * time.Hour},
+		{camera: "garden", base: "b", size: mb / 2, age: 80 * time.Hour},
+		{camera: "door", base: "c", size: mb / 2, age: 30 * time.Hour},
+		{camera: "door", base: "d", size: mb / 2, age: time.Hour},
+	}
+
+	tests := []struct {
+		name       string
+		maxAgeDays int
+		maxSizeMB  int
+		want       []string
+	}{
+		{name: "no retention", want: []string{"a", "b", "c", "d"}},
+		{name: "max age", maxAgeDays: 2, want: []string{"c", "d"}},
+		{name: "max age keeps all", maxAgeDays: 7, want: []string{"a", "b", "c", "d"}},
+		{name: "max size", maxSizeMB: 1, want: []string{"c", "d"}},
+		{name: "max size keeps all", maxSizeMB: 10, want: []string{"a", "b", "c", "d"}},
+		{name: "max age and size", maxAgeDays: 4, maxSizeMB: 1, want: []string{"c", "d"}},
+		{name: "max age before size", maxAgeDays: 1, maxSizeMB: 10, want: []string{"d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestArchive(t, root, archived)
+
+			archive := newTestArchive(t, root, tt.maxAgeDays, tt.maxSizeMB)
+			if err := archive.maintain(); err != nil {
+				t.Fatalf("maintain failed: %v", err)
+			}
+
+			var left []string
+			for _, a := range archived {
+				if _, err := os.Stat(filepath.Join(a.dir(root), a.base+".json")); err == nil {
+					left = append(left, a.base)
+				}
+			}
+			if !slices.Equal(left, tt.want) {
+				t.Errorf("maintain left %v, want %v", left, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveMaintainRemovesEmptyFolders(t *testing.T) {
+	root := t.TempDir()
+	old := []testArchived{
+		{camera: "garden", base: "a", size: 10, age: 100 * time.Hour},
+		{camera: "door", base: "b", size: 10, age: 100 * time.Hour},
+	}
+	writeTestArchive(t, root, old)
+	writeTestArchive(t, root, []testArchived{{camera: "door", base: "c", size: 10, age: time.Hour}})
+	// not emptied by the retention, so they stay
+	os.WriteFile(filepath.Join(root, "garden", "keep.txt"), []byte("x"), 0644)
+	os.MkdirAll(filepath.Join(root, "empty"), 0755)
+
+	if err := newTestArchive(t, root, 2, 0).maintain(); err != nil {
+		t.Fatalf("maintain failed: %v", err)
+	}
+
+	for _, a := range old {
+		if _, err := os.Stat(a.dir(root)); !os.IsNotExist(err) {
+			t.Errorf("emptied date folder %s is left behind", a.dir(root))
+		}
+	}
+	for _, dir := range []string{"garden", "door", "empty"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); err != nil {
+			t.Errorf("folder %s was removed: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DISCORD_TIMEOUT = 15 * time.Second
+
+	// limits of an embed, see https://discord.com/developers/docs/resources/message#embed-object-embed-limits
+	DISCORD_MAX_TITLE       = 256
+	DISCORD_MAX_DESCRIPTION = 4096
+)
+
+type FNDDiscordNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type DiscordTemplatePayload struct {
+	Active         bool
+	Webhooks       string
+	Username       string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+type DiscordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type DiscordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Timestamp   string              `json:"timestamp"`
+	Fields      []DiscordEmbedField `json:"fields"`
+	Image       *DiscordEmbedImage  `json:"image,omitempty"`
+}
+
+type DiscordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+type DiscordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []DiscordEmbed `json:"embeds"`
+}
+
+func (discord *FNDDiscordNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	discord.setConfiguration(conf)
+}
+
+func (discord *FNDDiscordNotificationSink) getName() string {
+	return "Discord"
+}
+
+func (discord *FNDDiscordNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		discord.setConfiguration(conf)
+	} else {
+		discord.createDefaultConfig()
+	}
+	discord.client = &http.Client{Timeout: DISCORD_TIMEOUT}
+	discord.setStatus("init")
+	return nil
+}
+
+func (discord *FNDDiscordNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	discord.webServer = webServer
+
+	discord.webServer.r.GET("/htmx/discord.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/discord.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, discord.generatePayload(discord.webServer.translatorFor(c), false))
+	})
+
+	discord.webServer.r.POST("/htmx/discord.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := discord.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := discord.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, discord.webServer.translation)
+		})
+
+		pay := discord.generatePayload(discord.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/discord.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Discord settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (discord *FNDDiscordNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	webhooks := strings.TrimSpace(c.PostForm("webhooks"))
+	username := strings.TrimSpace(c.PostForm("username"))
+
+	for _, webhook := range parseWebhookURLs(webhooks) {
+		if err := validateSinkURL(webhook); err != nil {
+			return errors.New(webhook + ": " + err.Error())
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	conf.Map["webhooks"] = webhooks
+	conf.Map["username"] = username
+	return nil
+}
+
+func (discord *FNDDiscordNotificationSink) generatePayload(tr Translator, postReq bool) DiscordTemplatePayload {
+	conf := discord.getConfiguration()
+	pay := DiscordTemplatePayload{
+		Active:    conf.enabled(),
+		Webhooks:  conf.Map["webhooks"],
+		Username:  conf.Map["username"],
+		Templates: generateSinkTemplatePayload(discord.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("discord_doc"),
+			tr.lookupToken("webhook_urls"),
+			tr.lookupToken("bot_name"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Webhook URLs are separated by newlines or whitespace, every URL posts to one channel
+func parseWebhookURLs(text string) []string {
+	return strings.Fields(text)
+}
+
+// Strips the request URL from a client error, webhook URLs contain their token
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// Truncates s to at most n runes
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func (discord *FNDDiscordNotificationSink) message(n FNDNotification) DiscordMessage {
+	conf := discord.getConfiguration()
+	tr := sinkTranslator(discord.webServer, conf)
+	embed := DiscordEmbed{
+		Title:       truncateRunes(n.Title, DISCORD_MAX_TITLE),
+		Description: truncateRunes(n.Caption, DISCORD_MAX_DESCRIPTION),
+		URL:         n.Event.ClipURL,
+		Timestamp:   n.Event.Time.UTC().Format(time.RFC3339),
+		Fields: []DiscordEmbedField{
+			{Name: tr.lookupToken("camera"), Value: n.Event.Camera, Inline: true},
+			{Name: tr.lookupToken("object"), Value: tr.label(n.Event.Label), Inline: true},
+			{Name: tr.lookupToken("score"), Value: strconv.Itoa(int(n.Event.Score*100+0.5)) + "%", Inline: true},
+		},
+	}
+	if len(n.JpegData) > 0 {
+		embed.Image = &DiscordEmbedImage{URL: "attachment://snapshot.jpg"}
+	}
+	return DiscordMessage{
+		Username: conf.Map["username"],
+		Embeds:   []DiscordEmbed{embed},
+	}
+}
+
+// Posts the embed with the snapshot as file, see https://discord.com/developers/docs/reference#uploading-files
+func (discord *FNDDiscordNotificationSink) post(ctx context.Context, webhook string, payloadJSON []byte, jpeg []byte) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("payload_json", string(payloadJSON)); err != nil {
+		return err
+	}
+	if len(jpeg) > 0 {
+		fileWriter, err := writer.CreateFormFile("files[0]", "snapshot.jpg")
+		if err != nil {
+			return err
+		}
+		if _, err = fileWriter.Write(jpeg); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := discord.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New("Discord statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+func (discord *FNDDiscordNotificationSink) sendNotification(n FNDNotification) error {
+	conf := discord.getConfiguration()
+	if !conf.enabled() {
+		discord.setStatus("disabled")
+		return nil
+	}
+	webhooks := parseWebhookURLs(conf.Map["webhooks"])
+	if len(webhooks) == 0 {
+		discord.setStatus("Webhook URL is empty!")
+		return errors.New("Webhook URL is empty!")
+	}
+
+	payloadJSON, err := json.Marshal(discord.message(n))
+	if err != nil {
+		return err
+	}
+
+	// the channels are posted one after another, all of them end at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), SINK_REQUEST_DEADLINE)
+	defer cancel()
+
+	// one broken channel must not keep the others from being notified
+	var failed, failedWebhooks []string
+	for i, webhook := range webhooks {
+		if !n.goesTo(webhook) {
+			continue
+		}
+		if err := discord.post(ctx, webhook, payloadJSON, n.JpegData); err != nil {
+			failed = append(failed, "channel "+strconv.Itoa(i+1)+": "+err.Error())
+			failedWebhooks = append(failedWebhooks, webhook)
+		}
+	}
+
+	if len(failed) > 0 {
+		discord.setStatus(strconv.Itoa(len(failed)) + "/" + strconv.Itoa(len(webhooks)) + " channels failed")
+		return &FNDFailedTargetsError{Targets: failedWebhooks, Err: errors.New("Discord: " + strings.Join(failed, "; "))}
+	}
+	discord.setStatus("Online")
+	return nil
+}
+
+func (discord *FNDDiscordNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return discord.getConfiguration(), nil
+}
+
+func (discord *FNDDiscordNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := discord.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    discord.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
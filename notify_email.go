@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EMAIL_SECURITY_STARTTLS = "starttls"
+	EMAIL_SECURITY_TLS      = "tls"
+	EMAIL_SECURITY_NONE     = "none"
+
+	EMAIL_DEFAULT_PORT = 587
+	EMAIL_TIMEOUT      = 30 * time.Second
+	EMAIL_SNAPSHOT_CID = "snapshot@fnd"
+)
+
+const DEFAULT_EMAIL_BODY_TEMPLATE = `<h2>{{.Title}}</h2>
+<p>{{.Caption}}</p>
+<p><img src="{{.SnapshotSrc}}" alt="Snapshot" style="max-width: 100%;"></p>
+<p><a href="{{.ClipURL}}">Clip</a> {{date .Time}}</p>`
+
+var emailSecurityModes = []string{EMAIL_SECURITY_STARTTLS, EMAIL_SECURITY_TLS, EMAIL_SECURITY_NONE}
+
+type FNDEmailNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+}
+
+// Everything the HTML body template has access to: the fields of the caption templates,
+// the rendered caption and title and the src of the inline snapshot
+type EmailBodyData struct {
+	FNDNotificationEvent
+	Title       string
+	Caption     string
+	SnapshotSrc htmltemplate.URL
+}
+
+type EmailTemplatePayload struct {
+	Active         bool
+	Host           string
+	Port           string
+	Security       string
+	Username       string
+	HasPassword    bool
+	From           string
+	To             string
+	BodyTemplate   string
+	DefaultBody    string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (email *FNDEmailNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["port"] = strconv.Itoa(EMAIL_DEFAULT_PORT)
+	conf.Map["security"] = EMAIL_SECURITY_STARTTLS
+	email.setConfiguration(conf)
+}
+
+func (email *FNDEmailNotificationSink) getName() string {
+	return "Email"
+}
+
+func (email *FNDEmailNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		email.setConfiguration(conf)
+	} else {
+		email.createDefaultConfig()
+	}
+	email.setStatus("init")
+	return nil
+}
+
+func (email *FNDEmailNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	email.webServer = webServer
+
+	email.webServer.r.GET("/htmx/email.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/email.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, email.generatePayload(email.webServer.translatorFor(c), false))
+	})
+
+	// action "test" applies the settings and sends a test mail right away
+	email.webServer.r.POST("/htmx/email.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := email.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := email.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, email.webServer.translation)
+		})
+		if err == nil && c.PostForm("action") == "test" {
+			err = email.sendTest()
+		}
+
+		pay := email.generatePayload(email.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/email.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the email settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (email *FNDEmailNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	host := strings.TrimSpace(c.PostForm("host"))
+	port := strings.TrimSpace(c.PostForm("port"))
+	security := c.PostForm("security")
+	username := strings.TrimSpace(c.PostForm("username"))
+	password := c.PostForm("password")
+	from := strings.TrimSpace(c.PostForm("from"))
+	to := strings.TrimSpace(c.PostForm("to"))
+	body := strings.TrimSpace(c.PostForm("body_template"))
+
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("Invalid port: " + port)
+		}
+	}
+	if !slices.Contains(emailSecurityModes, security) {
+		return errors.New("Unknown security: " + security)
+	}
+	if from != "" {
+		if _, err := mail.ParseAddress(from); err != nil {
+			return errors.New("Sender: " + err.Error())
+		}
+	}
+	if to != "" {
+		if _, err := parseEmailRecipients(to); err != nil {
+			return err
+		}
+	}
+	if body != "" {
+		if err := validateEmailBody(body); err != nil {
+			return errors.New("Body: " + err.Error())
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if host != "" {
+		conf.Map["host"] = host
+	}
+	if port != "" {
+		conf.Map["port"] = port
+	}
+	conf.Map["security"] = security
+	conf.Map["username"] = username
+	if password != "" {
+		conf.Map["password"] = password
+	}
+	if c.PostForm("clear_password") != "" {
+		delete(conf.Map, "password")
+	}
+	if from != "" {
+		conf.Map["from"] = from
+	}
+	if to != "" {
+		conf.Map["to"] = to
+	}
+	conf.Map["body_template"] = body
+	return nil
+}
+
+func (email *FNDEmailNotificationSink) generatePayload(tr Translator, postReq bool) EmailTemplatePayload {
+	conf := email.getConfiguration()
+	security := conf.Map["security"]
+	if security == "" {
+		security = EMAIL_SECURITY_STARTTLS
+	}
+
+	pay := EmailTemplatePayload{
+		Active:       conf.enabled(),
+		Host:         conf.Map["host"],
+		Port:         email.port(),
+		Security:     security,
+		Username:     conf.Map["username"],
+		HasPassword:  conf.Map["password"] != "",
+		From:         conf.Map["from"],
+		To:           conf.Map["to"],
+		BodyTemplate: conf.Map["body_template"],
+		DefaultBody:  DEFAULT_EMAIL_BODY_TEMPLATE,
+		Templates:    generateSinkTemplatePayload(email.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("email_doc"),
+			tr.lookupToken("smtp_server"),
+			tr.lookupToken("port"),
+			tr.lookupToken("security"),
+			tr.lookupToken("username"),
+			tr.lookupToken("password"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("sender"),
+			tr.lookupToken("recipients"),
+			tr.lookupToken("html_body"),
+			tr.lookupToken("template_default"),
+			tr.lookupToken("default"),
+			tr.lookupToken("send_test"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (email *FNDEmailNotificationSink) port() string {
+	conf := email.getConfiguration()
+	if port := conf.Map["port"]; port != "" {
+		return port
+	}
+	return strconv.Itoa(EMAIL_DEFAULT_PORT)
+}
+
+// Recipients are separated by commas or newlines
+func parseEmailRecipients(text string) ([]string, error) {
+	var recipients []string
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(field)
+		if err != nil {
+			return nil, errors.New("Recipient " + field + ": " + err.Error())
+		}
+		recipients = append(recipients, addr.Address)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("No recipients")
+	}
+	return recipients, nil
+}
+
+func renderEmailBody(text string, data EmailBodyData, tr Translator) (string, error) {
+	funcs := htmltemplate.FuncMap(notificationTemplateFuncs(tr))
+	t, err := htmltemplate.New("email").Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func validateEmailBody(text string) error {
+	data := EmailBodyData{
+		FNDNotificationEvent: sampleFNDNotificationEvent(&FNDFrigateConfiguration{}),
+		Title:                "Title",
+		Caption:              "Caption",
+		SnapshotSrc:          "cid:" + EMAIL_SNAPSHOT_CID,
+	}
+	_, err := renderEmailBody(text, data, Translator{})
+	return err
+}
+
+func (email *FNDEmailNotificationSink) sendNotification(n FNDNotification) error {
+	conf := email.getConfiguration()
+	if !conf.enabled() {
+		email.setStatus("disabled")
+		return nil
+	}
+	return email.deliver(n)
+}
+
+// Sends the sample notification, even if the sink is disabled
+func (email *FNDEmailNotificationSink) sendTest() error {
+	conf := email.getConfiguration()
+	n, err := email.webServer.testNotification()
+	if err != nil {
+		return err
+	}
+	return email.deliver(n.forSink(conf, sinkTranslator(email.webServer, conf)))
+}
+
+func (email *FNDEmailNotificationSink) deliver(n FNDNotification) error {
+	conf := email.getConfiguration()
+	host := conf.Map["host"]
+	from := conf.Map["from"]
+	if host == "" || from == "" {
+		email.setStatus("Server or sender is empty!")
+		return errors.New("Server or sender is empty!")
+	}
+	recipients, err := parseEmailRecipients(conf.Map["to"])
+	if err != nil {
+		email.setStatus(err.Error())
+		return err
+	}
+
+	msg, err := email.message(n, from, recipients)
+	if err != nil {
+		email.setStatus(err.Error())
+		return err
+	}
+
+	err = email.send(host, from, recipients, msg)
+	if err != nil {
+		email.setStatus(err.Error())
+		return err
+	}
+	email.setStatus("Online")
+	return nil
+}
+
+// Builds a multipart/related mail of a plain text and HTML alternative and the
+// snapshot, which the HTML part references by its Content-ID
+func (email *FNDEmailNotificationSink) message(n FNDNotification, from string, recipients []string) ([]byte, error) {
+	conf := email.getConfiguration()
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, errors.New("Sender: " + err.Error())
+	}
+
+	bodyTemplate := conf.Map["body_template"]
+	if bodyTemplate == "" {
+		bodyTemplate = DEFAULT_EMAIL_BODY_TEMPLATE
+	}
+	html, err := renderEmailBody(bodyTemplate, EmailBodyData{
+		FNDNotificationEvent: n.Event,
+		Title:                n.Title,
+		Caption:              n.Caption,
+		SnapshotSrc:          "cid:" + EMAIL_SNAPSHOT_CID,
+	}, sinkTranslator(email.webServer, conf))
+	if err != nil {
+		return nil, errors.New("Email body template: " + err.Error())
+	}
+
+	var alternativeBody bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBody)
+	for _, alt := range []struct {
+		contentType string
+		text        string
+	}{
+		{"text/plain; charset=utf-8", n.Caption + "\r\n\r\n" + n.Event.ClipURL},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alt.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(alt.text)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err = alternative.Close(); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	related := multipart.NewWriter(&body)
+	part, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(alternativeBody.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if len(n.JpegData) > 0 {
+		w, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Id":                {"<" + EMAIL_SNAPSHOT_CID + ">"},
+			"Content-Disposition":       {`inline; filename="snapshot.jpg"`},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(wrapBase64(n.JpegData)); err != nil {
+			return nil, err
+		}
+	}
+	if err = related.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", sender.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", emailMessageID(sender.Address))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/related; type=\"multipart/alternative\"; boundary=%s\r\n\r\n", related.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// Base64 with lines of 76 characters as required by RFC 2045
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
+
+func emailMessageID(from string) string {
+	domain := "fnd"
+	if _, d, found := strings.Cut(from, "@"); found {
+		domain = d
+	}
+	random := make([]byte, 12)
+	rand.Read(random)
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">"
+}
+
+// Connects with implicit TLS, STARTTLS (required, no fallback to plain text) or without encryption
+func (email *FNDEmailNotificationSink) send(host string, from string, recipients []string, msg []byte) error {
+	conf := email.getConfiguration()
+	addr := net.JoinHostPort(host, email.port())
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: EMAIL_TIMEOUT}
+
+	var conn net.Conn
+	var err error
+	if conf.Map["security"] == EMAIL_SECURITY_TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(EMAIL_TIMEOUT))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	security := conf.Map["security"]
+	if security == EMAIL_SECURITY_STARTTLS || security == "" {
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return errors.New("STARTTLS: " + err.Error())
+		}
+	}
+
+	if username := conf.Map["username"]; username != "" {
+		auth := smtp.PlainAuth("", username, conf.Map["password"], host)
+		if err = client.Auth(auth); err != nil {
+			return errors.New("Authentication: " + err.Error())
+		}
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+	if err = client.Mail(sender.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err = client.Rcpt(rcpt); err != nil {
+			return errors.New("Recipient " + rcpt + ": " + err.Error())
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (email *FNDEmailNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return email.getConfiguration(), nil
+}
+
+func (email *FNDEmailNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := email.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    email.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
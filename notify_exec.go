@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EXEC_DEFAULT_TIMEOUT     = 30
+	EXEC_DEFAULT_CONCURRENCY = 2
+	// the command has to be killed well before the delivery times out
+	EXEC_MAX_TIMEOUT = int(SINK_REQUEST_DEADLINE / time.Second)
+	// how much of stderr ends up in the status
+	EXEC_STDERR_TAIL = 512
+)
+
+type FNDExecNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+}
+
+type ExecTemplatePayload struct {
+	Active         bool
+	Command        string
+	Timeout        string
+	MaxTimeout     int
+	Concurrency    string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+// JSON written to stdin of the command
+type ExecRecord struct {
+	FNDNotificationRecord
+	SnapshotFile string `json:"snapshot_file,omitempty"`
+}
+
+// Keeps the last max bytes written to it
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (execSink *FNDExecNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["command"] = ""
+	conf.Map["timeout"] = strconv.Itoa(EXEC_DEFAULT_TIMEOUT)
+	conf.Map["concurrency"] = strconv.Itoa(EXEC_DEFAULT_CONCURRENCY)
+	execSink.setConfiguration(conf)
+}
+
+func (execSink *FNDExecNotificationSink) getName() string {
+	return "Exec"
+}
+
+func (execSink *FNDExecNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		execSink.setConfiguration(conf)
+	} else {
+		execSink.createDefaultConfig()
+	}
+	execSink.setStatus("init")
+	return nil
+}
+
+func (execSink *FNDExecNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	execSink.webServer = webServer
+
+	execSink.webServer.r.GET("/htmx/exec.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/exec.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, execSink.generatePayload(execSink.webServer.translatorFor(c), false))
+	})
+
+	execSink.webServer.r.POST("/htmx/exec.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := execSink.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := execSink.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, execSink.webServer.translation)
+		})
+
+		pay := execSink.generatePayload(execSink.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/exec.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the exec settings form into the configuration.
+// The command itself can only be set in the configuration file, the web
+// interface must not be a way to run arbitrary programs on the host.
+func (execSink *FNDExecNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	timeout := strings.TrimSpace(c.PostForm("timeout"))
+	concurrency := strings.TrimSpace(c.PostForm("concurrency"))
+
+	if timeout != "" {
+		if n, err := strconv.Atoi(timeout); err != nil || n < 1 || n > EXEC_MAX_TIMEOUT {
+			return errors.New("Timeout must be a number of seconds from 1 to " + strconv.Itoa(EXEC_MAX_TIMEOUT))
+		}
+	}
+	if concurrency != "" {
+		if n, err := strconv.Atoi(concurrency); err != nil || n < 1 {
+			return errors.New("Concurrency must be a number greater than 0")
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if timeout != "" {
+		conf.Map["timeout"] = timeout
+	}
+	if concurrency != "" {
+		conf.Map["concurrency"] = concurrency
+	}
+	return nil
+}
+
+func (execSink *FNDExecNotificationSink) generatePayload(tr Translator, postReq bool) ExecTemplatePayload {
+	conf := execSink.getConfiguration()
+	pay := ExecTemplatePayload{
+		Active:      conf.enabled(),
+		Command:     conf.Map["command"],
+		Timeout:     strconv.Itoa(int(execSink.timeout() / time.Second)),
+		MaxTimeout:  EXEC_MAX_TIMEOUT,
+		Concurrency: strconv.Itoa(execSink.intOption("concurrency", EXEC_DEFAULT_CONCURRENCY)),
+		Templates:   generateSinkTemplatePayload(execSink.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("exec_doc"),
+			tr.lookupToken("command"),
+			tr.lookupToken("timeout_seconds"),
+			tr.lookupToken("concurrency"),
+			tr.lookupToken("command_from_config"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// The notification manager runs as many commands at a time
+func (execSink *FNDExecNotificationSink) concurrency() int {
+	return execSink.intOption("concurrency", EXEC_DEFAULT_CONCURRENCY)
+}
+
+// Longer timeouts from the configuration file are cut to EXEC_MAX_TIMEOUT
+func (execSink *FNDExecNotificationSink) timeout() time.Duration {
+	return time.Duration(min(execSink.intOption("timeout", EXEC_DEFAULT_TIMEOUT), EXEC_MAX_TIMEOUT)) * time.Second
+}
+
+func (execSink *FNDExecNotificationSink) intOption(key string, def int) int {
+	conf := execSink.getConfiguration()
+	n, err := strconv.Atoi(conf.Map[key])
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
+// Environment of the command, the same values as the JSON on stdin
+func execEnvironment(r ExecRecord) []string {
+	env := []string{
+		"FND_ID=" + r.ID,
+		"FND_CAMERA=" + r.Camera,
+		"FND_LABEL=" + r.Label,
+		"FND_SUB_LABEL=" + r.SubLabel,
+		"FND_SCORE=" + strconv.FormatFloat(float64(r.Score), 'f', 2, 32),
+		"FND_TOP_SCORE=" + strconv.FormatFloat(float64(r.TopScore), 'f', 2, 32),
+		"FND_ZONES=" + strings.Join(r.Zones, ","),
+		"FND_TIME=" + r.Time.Format(time.RFC3339),
+		"FND_TITLE=" + r.Title,
+		"FND_CAPTION=" + r.Caption,
+		"FND_FRIGATE_URL=" + r.FrigateURL,
+		"FND_SNAPSHOT_URL=" + r.SnapshotURL,
+		"FND_CLIP_URL=" + r.ClipURL,
+		"FND_SNAPSHOT_FILE=" + r.SnapshotFile,
+	}
+	if r.Decision != nil {
+		env = append(env, "FND_DECISION="+r.Decision.Decision, "FND_REASON="+r.Decision.Reason)
+	}
+	return append(os.Environ(), env...)
+}
+
+// Runs the command, killing it after the timeout
+func (execSink *FNDExecNotificationSink) sendNotification(n FNDNotification) error {
+	conf := execSink.getConfiguration()
+	if !conf.enabled() {
+		execSink.setStatus("disabled")
+		return nil
+	}
+	args := strings.Fields(conf.Map["command"])
+	if len(args) == 0 {
+		execSink.setStatus("Command is empty!")
+		return errors.New("Command is empty!")
+	}
+	timeout := execSink.timeout()
+
+	record := ExecRecord{FNDNotificationRecord: newNotificationRecord(execSink.webServer, n)}
+	if len(n.JpegData) > 0 {
+		f, err := os.CreateTemp("", "fnd-snapshot-*.jpg")
+		if err != nil {
+			execSink.setStatus(err.Error())
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(n.JpegData)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			execSink.setStatus(err.Error())
+			return err
+		}
+		record.SnapshotFile = f.Name()
+	}
+	stdin, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stderr := &tailBuffer{max: EXEC_STDERR_TAIL}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = execEnvironment(record)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = stderr
+	// children keeping stderr open must not block us beyond the timeout
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		execSink.setStatus("Timeout after " + timeout.String())
+		return errors.New("Command timed out after " + timeout.String())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		execSink.setStatus("Exit code " + strconv.Itoa(exitErr.ExitCode()))
+		msg := "Command failed with exit code " + strconv.Itoa(exitErr.ExitCode())
+		if lines := strings.Split(strings.TrimSpace(string(stderr.buf)), "\n"); lines[len(lines)-1] != "" {
+			msg += ": " + lines[len(lines)-1]
+		}
+		return errors.New(msg)
+	}
+	if err != nil {
+		execSink.setStatus(err.Error())
+		return err
+	}
+	execSink.setStatus("Online")
+	return nil
+}
+
+func (execSink *FNDExecNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return execSink.getConfiguration(), nil
+}
+
+func (execSink *FNDExecNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := execSink.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    execSink.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
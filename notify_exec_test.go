@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		writes []string
+		want   string
+	}{
+		{name: "nothing written", max: 8, want: ""},
+		{name: "shorter than max", max: 8, writes: []string{"abc"}, want: "abc"},
+		{name: "exactly max", max: 8, writes: []string{"abcdefgh"}, want: "abcdefgh"},
+		{name: "one long write", max: 8, writes: []string{"0123456789abcdef"}, want: "89abcdef"},
+		{name: "several writes", max: 8, writes: []string{"error: ", "disk ", "full\n"}, want: "sk full\n"},
+		{name: "write after overflow", max: 4, writes: []string{"abcdefgh", "ij"}, want: "ghij"},
+		{name: "empty writes", max: 4, writes: []string{"", "ab", ""}, want: "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &tailBuffer{max: tt.max}
+			for _, w := range tt.writes {
+				n, err := buf.Write([]byte(w))
+				if n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v, want %d, nil", w, n, err, len(w))
+				}
+			}
+			if got := string(buf.buf); got != tt.want {
+				t.Errorf("tail = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailBufferStaysSmall(t *testing.T) {
+	buf := &tailBuffer{max: EXEC_STDERR_TAIL}
+	for range 1000 {
+		buf.Write([]byte(strings.Repeat("x", 100)))
+	}
+	if len(buf.buf) != EXEC_STDERR_TAIL {
+		t.Errorf("tail has %d bytes, want %d", len(buf.buf), EXEC_STDERR_TAIL)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	tests := []struct {
+		timeout string
+		want    time.Duration
+	}{
+		{timeout: "10", want: 10 * time.Second},
+		{timeout: "60", want: 60 * time.Second},
+		// longer ones from the configuration file are cut below SINK_DELIVERY_TIMEOUT
+		{timeout: "600", want: time.Duration(EXEC_MAX_TIMEOUT) * time.Second},
+		{timeout: "0", want: EXEC_DEFAULT_TIMEOUT * time.Second},
+		{timeout: "-5", want: EXEC_DEFAULT_TIMEOUT * time.Second},
+		{timeout: "", want: EXEC_DEFAULT_TIMEOUT * time.Second},
+		{timeout: "soon", want: EXEC_DEFAULT_TIMEOUT * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timeout, func(t *testing.T) {
+			conf := NEWDefaultFNDNotificationConfigurationMap()
+			conf.Map["timeout"] = tt.timeout
+			execSink := &FNDExecNotificationSink{}
+			execSink.setup(conf, true)
+
+			got := execSink.timeout()
+			if got != tt.want {
+				t.Errorf("timeout with %q = %s, want %s", tt.timeout, got, tt.want)
+			}
+			if got >= SINK_DELIVERY_TIMEOUT {
+				t.Errorf("timeout with %q = %s, not below SINK_DELIVERY_TIMEOUT", tt.timeout, got)
+			}
+		})
+	}
+}
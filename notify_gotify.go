@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GOTIFY_DEFAULT_PRIORITY = 5
+	GOTIFY_MAX_PRIORITY     = 10
+	GOTIFY_TIMEOUT          = 10 * time.Second
+)
+
+type FNDGotifyNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+// Body of POST /message, see https://gotify.net/api-docs
+type GotifyMessage struct {
+	Title    string         `json:"title"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+type GotifyTemplatePayload struct {
+	Active         bool
+	Server         string
+	HasToken       bool
+	Priority       string
+	Priorities     string
+	Markdown       bool
+	EmbedImage     bool
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (gotify *FNDGotifyNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["priority"] = strconv.Itoa(GOTIFY_DEFAULT_PRIORITY)
+	conf.Map["markdown"] = "true"
+	conf.Map["image"] = "true"
+	gotify.setConfiguration(conf)
+}
+
+func (gotify *FNDGotifyNotificationSink) getName() string {
+	return "Gotify"
+}
+
+func (gotify *FNDGotifyNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		gotify.setConfiguration(conf)
+	} else {
+		gotify.createDefaultConfig()
+	}
+	gotify.client = &http.Client{Timeout: GOTIFY_TIMEOUT}
+	gotify.setStatus("init")
+	return nil
+}
+
+func (gotify *FNDGotifyNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	gotify.webServer = webServer
+
+	gotify.webServer.r.GET("/htmx/gotify.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/gotify.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, gotify.generatePayload(gotify.webServer.translatorFor(c), false))
+	})
+
+	gotify.webServer.r.POST("/htmx/gotify.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := gotify.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := gotify.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, gotify.webServer.translation)
+		})
+
+		pay := gotify.generatePayload(gotify.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/gotify.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Gotify settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (gotify *FNDGotifyNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	server := strings.TrimRight(strings.TrimSpace(c.PostForm("server")), "/")
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	priority := strings.TrimSpace(c.PostForm("priority"))
+	priorities := strings.TrimSpace(c.PostForm("priorities"))
+
+	if server != "" {
+		if err := validateSinkURL(server); err != nil {
+			return err
+		}
+	}
+	if priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil || n < 0 || n > GOTIFY_MAX_PRIORITY {
+			return errors.New("Priority must be between 0 and " + strconv.Itoa(GOTIFY_MAX_PRIORITY))
+		}
+	}
+	if _, err := parsePriorityRules(priorities, 0, GOTIFY_MAX_PRIORITY); err != nil {
+		return err
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if server != "" {
+		conf.Map["server"] = server
+	}
+	if token != "" {
+		conf.Map["token"] = token
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+	}
+	if priority != "" {
+		conf.Map["priority"] = priority
+	}
+	conf.Map["priorities"] = priorities
+	conf.Map["markdown"] = strconv.FormatBool(c.PostForm("markdown") != "")
+	conf.Map["image"] = strconv.FormatBool(c.PostForm("image") != "")
+	return nil
+}
+
+func (gotify *FNDGotifyNotificationSink) generatePayload(tr Translator, postReq bool) GotifyTemplatePayload {
+	conf := gotify.getConfiguration()
+	pay := GotifyTemplatePayload{
+		Active:     conf.enabled(),
+		Server:     conf.Map["server"],
+		HasToken:   conf.Map["token"] != "",
+		Priority:   strconv.Itoa(gotify.priority()),
+		Priorities: conf.Map["priorities"],
+		Markdown:   conf.Map["markdown"] == "true",
+		EmbedImage: conf.Map["image"] == "true",
+		Templates:  generateSinkTemplatePayload(gotify.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("gotify_doc"),
+			tr.lookupToken("server"),
+			tr.lookupToken("app_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("priority"),
+			tr.lookupToken("priority_rules"),
+			tr.lookupToken("markdown"),
+			tr.lookupToken("embed_image"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (gotify *FNDGotifyNotificationSink) priority() int {
+	conf := gotify.getConfiguration()
+	n, err := strconv.Atoi(conf.Map["priority"])
+	if err != nil || n < 0 || n > GOTIFY_MAX_PRIORITY {
+		return GOTIFY_DEFAULT_PRIORITY
+	}
+	return n
+}
+
+// Gotify cannot take attachments, the snapshot is linked from Frigate instead
+func (gotify *FNDGotifyNotificationSink) message(n FNDNotification) GotifyMessage {
+	conf := gotify.getConfiguration()
+	rules, err := parsePriorityRules(conf.Map["priorities"], 0, GOTIFY_MAX_PRIORITY)
+	if err != nil {
+		LogWarn("Gotify priority rules ignored: %v", err)
+	}
+
+	// used by the Android app, see https://gotify.net/docs/msgextras
+	notification := map[string]any{
+		"click": map[string]string{"url": n.Event.ClipURL},
+	}
+	if conf.Map["image"] == "true" {
+		notification["bigImageUrl"] = n.Event.SnapshotURL
+	}
+
+	msg := GotifyMessage{
+		Title:    n.Title,
+		Message:  n.Caption,
+		Priority: priorityFor(rules, n.Event, gotify.priority()),
+		Extras:   map[string]any{"client::notification": notification},
+	}
+
+	if conf.Map["markdown"] == "true" {
+		msg.Extras["client::display"] = map[string]string{"contentType": "text/markdown"}
+		if conf.Map["image"] == "true" {
+			msg.Message += "\n\n![snapshot](" + n.Event.SnapshotURL + ")"
+		}
+	}
+	return msg
+}
+
+func (gotify *FNDGotifyNotificationSink) sendNotification(n FNDNotification) error {
+	conf := gotify.getConfiguration()
+	if !conf.enabled() {
+		gotify.setStatus("disabled")
+		return nil
+	}
+	server := conf.Map["server"]
+	token := conf.Map["token"]
+	if server == "" || token == "" {
+		gotify.setStatus("Server or token is empty!")
+		return errors.New("Server or token is empty!")
+	}
+
+	body, err := json.Marshal(gotify.message(n))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", token)
+
+	resp, err := gotify.client.Do(req)
+	if err != nil {
+		gotify.setStatus(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		gotify.setStatus("Gotify statuscode: " + strconv.Itoa(resp.StatusCode))
+		return errors.New("Gotify statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(reply)))
+	}
+	gotify.setStatus("Online")
+	return nil
+}
+
+func (gotify *FNDGotifyNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return gotify.getConfiguration(), nil
+}
+
+func (gotify *FNDGotifyNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := gotify.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    gotify.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
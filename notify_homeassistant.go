@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HOMEASSISTANT_TIMEOUT = 15 * time.Second
+
+	HOMEASSISTANT_DEFAULT_ACTIONS = "Clip = {{.ClipURL}}"
+)
+
+type FNDHomeAssistantNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type HomeAssistantTemplatePayload struct {
+	Active         bool
+	URL            string
+	HasToken       bool
+	Services       string
+	FndURL         string
+	Actions        string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+// One button of an actionable notification, see https://companion.home-assistant.io/docs/notifications/actionable-notifications
+type HomeAssistantAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	URI    string `json:"uri,omitempty"`
+}
+
+type HomeAssistantNotifyData struct {
+	Image       string                `json:"image,omitempty"`
+	URL         string                `json:"url,omitempty"`
+	ClickAction string                `json:"clickAction,omitempty"`
+	Group       string                `json:"group"`
+	Tag         string                `json:"tag"`
+	Actions     []HomeAssistantAction `json:"actions,omitempty"`
+}
+
+type HomeAssistantNotify struct {
+	Title   string                  `json:"title"`
+	Message string                  `json:"message"`
+	Data    HomeAssistantNotifyData `json:"data"`
+}
+
+func (ha *FNDHomeAssistantNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["url"] = "http://homeassistant.local:8123"
+	conf.Map["actions"] = HOMEASSISTANT_DEFAULT_ACTIONS
+	ha.setConfiguration(conf)
+}
+
+func (ha *FNDHomeAssistantNotificationSink) getName() string {
+	return "HomeAssistant"
+}
+
+func (ha *FNDHomeAssistantNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		ha.setConfiguration(conf)
+	} else {
+		ha.createDefaultConfig()
+	}
+	ha.client = &http.Client{Timeout: HOMEASSISTANT_TIMEOUT}
+	ha.setStatus("init")
+	return nil
+}
+
+func (ha *FNDHomeAssistantNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	ha.webServer = webServer
+
+	ha.webServer.r.GET("/htmx/homeassistant.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/homeassistant.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, ha.generatePayload(ha.webServer.translatorFor(c), false))
+	})
+
+	ha.webServer.r.POST("/htmx/homeassistant.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := ha.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := ha.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, ha.webServer.translation)
+		})
+		// checks URL and token right away, so a typo shows up before the first event
+		if err == nil && ha.getConfiguration().Map["token"] != "" {
+			err = ha.checkAPI()
+		}
+
+		pay := ha.generatePayload(ha.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/homeassistant.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Services are the names of notify services like mobile_app_pixel_7, the domain notify. is optional.
+// They are separated by commas or newlines.
+func parseHomeAssistantServices(text string) []string {
+	var services []string
+	for _, service := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		service = strings.TrimPrefix(strings.TrimSpace(service), "notify.")
+		if service != "" {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+func isHomeAssistantService(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Every line "title = target" is a button. Targets starting with http(s):// or / are
+// URI templates opened by the app, everything else is an action ID for automations.
+func parseHomeAssistantActions(text string) ([]HomeAssistantAction, error) {
+	var actions []HomeAssistantAction
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		title, target, found := strings.Cut(line, "=")
+		title = strings.TrimSpace(title)
+		target = strings.TrimSpace(target)
+		if !found || title == "" || target == "" {
+			return nil, errors.New("Action " + strconv.Itoa(i+1) + ": expected title = target")
+		}
+
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "/") || strings.HasPrefix(target, "{{") {
+			if err := validateNotificationTemplate(target); err != nil {
+				return nil, errors.New("Action " + strconv.Itoa(i+1) + ": " + err.Error())
+			}
+			actions = append(actions, HomeAssistantAction{Action: "URI", Title: title, URI: target})
+		} else {
+			actions = append(actions, HomeAssistantAction{Action: target, Title: title})
+		}
+	}
+	return actions, nil
+}
+
+// Reads the Home Assistant settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (ha *FNDHomeAssistantNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	haURL := strings.TrimRight(strings.TrimSpace(c.PostForm("url")), "/")
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	services := strings.TrimSpace(c.PostForm("services"))
+	fndURL := strings.TrimRight(strings.TrimSpace(c.PostForm("fnd_url")), "/")
+	actions := strings.TrimSpace(c.PostForm("actions"))
+
+	if haURL != "" {
+		if err := validateSinkURL(haURL); err != nil {
+			return err
+		}
+	}
+	for _, service := range parseHomeAssistantServices(services) {
+		if !isHomeAssistantService(service) {
+			return errors.New("Not a notify service like mobile_app_pixel_7: " + service)
+		}
+	}
+	if fndURL != "" {
+		if err := validateSinkURL(fndURL); err != nil {
+			return err
+		}
+	}
+	if _, err := parseHomeAssistantActions(actions); err != nil {
+		return err
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if haURL != "" {
+		conf.Map["url"] = haURL
+	}
+	if token != "" {
+		conf.Map["token"] = token
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+	}
+	conf.Map["services"] = services
+	conf.Map["fnd_url"] = fndURL
+	conf.Map["actions"] = actions
+	return nil
+}
+
+func (ha *FNDHomeAssistantNotificationSink) generatePayload(tr Translator, postReq bool) HomeAssistantTemplatePayload {
+	conf := ha.getConfiguration()
+	pay := HomeAssistantTemplatePayload{
+		Active:    conf.enabled(),
+		URL:       conf.Map["url"],
+		HasToken:  conf.Map["token"] != "",
+		Services:  conf.Map["services"],
+		FndURL:    conf.Map["fnd_url"],
+		Actions:   conf.Map["actions"],
+		Templates: generateSinkTemplatePayload(ha.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("homeassistant_doc"),
+			tr.lookupToken("server"),
+			tr.lookupToken("long_lived_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("notify_services"),
+			tr.lookupToken("fnd_url"),
+			tr.lookupToken("actions"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (ha *FNDHomeAssistantNotificationSink) request(ctx context.Context, method string, path string, body []byte) error {
+	conf := ha.getConfiguration()
+	req, err := http.NewRequestWithContext(ctx, method, conf.Map["url"]+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Map["token"])
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ha.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New("Home Assistant statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// GET /api/ answers with 200 if URL and token are valid
+func (ha *FNDHomeAssistantNotificationSink) checkAPI() error {
+	conf := ha.getConfiguration()
+	if conf.Map["url"] == "" {
+		return errors.New("URL is empty!")
+	}
+	err := ha.request(context.Background(), http.MethodGet, "/api/", nil)
+	if err != nil {
+		ha.setStatus(err.Error())
+		return err
+	}
+	ha.setStatus("Online")
+	return nil
+}
+
+func (ha *FNDHomeAssistantNotificationSink) message(n FNDNotification) HomeAssistantNotify {
+	conf := ha.getConfiguration()
+	msg := HomeAssistantNotify{
+		Title:   n.Title,
+		Message: n.Caption,
+		Data: HomeAssistantNotifyData{
+			// notifications of the same camera are grouped, updates of the same event replace each other
+			Group: n.Event.Camera,
+			Tag:   n.ID,
+			URL:   n.Event.ClipURL,
+		},
+	}
+	msg.Data.ClickAction = msg.Data.URL
+
+	// the app loads the image itself, so it has to be served by fnd
+	if fndURL := conf.Map["fnd_url"]; fndURL != "" && len(n.JpegData) > 0 {
+		msg.Data.Image = fndURL + "/history/snapshot/" + url.PathEscape(n.ID)
+	}
+
+	actions, err := parseHomeAssistantActions(conf.Map["actions"])
+	if err != nil {
+		LogWarn("Home Assistant actions ignored: %v", err)
+	}
+	tr := sinkTranslator(ha.webServer, conf)
+	for _, action := range actions {
+		if action.Action == "URI" {
+			action.URI, err = renderNotificationTemplate(action.URI, n.Event, tr)
+			if err != nil || action.URI == "" {
+				continue
+			}
+		}
+		msg.Data.Actions = append(msg.Data.Actions, action)
+	}
+	return msg
+}
+
+// Calls notify.<service> for every configured service
+func (ha *FNDHomeAssistantNotificationSink) sendNotification(n FNDNotification) error {
+	conf := ha.getConfiguration()
+	if !conf.enabled() {
+		ha.setStatus("disabled")
+		return nil
+	}
+	services := parseHomeAssistantServices(conf.Map["services"])
+	if conf.Map["url"] == "" || conf.Map["token"] == "" || len(services) == 0 {
+		ha.setStatus("URL, token or services are empty!")
+		return errors.New("URL, token or services are empty!")
+	}
+
+	body, err := json.Marshal(ha.message(n))
+	if err != nil {
+		return err
+	}
+
+	// the services are called one after another, all of them end at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), SINK_REQUEST_DEADLINE)
+	defer cancel()
+
+	// one unreachable phone must not keep the others from being notified
+	var failed, failedServices []string
+	for _, service := range services {
+		if !n.goesTo(service) {
+			continue
+		}
+		if err := ha.request(ctx, http.MethodPost, "/api/services/notify/"+service, body); err != nil {
+			failed = append(failed, service+": "+err.Error())
+			failedServices = append(failedServices, service)
+		}
+	}
+
+	if len(failed) > 0 {
+		ha.setStatus(strconv.Itoa(len(failed)) + "/" + strconv.Itoa(len(services)) + " services failed")
+		return &FNDFailedTargetsError{Targets: failedServices, Err: errors.New("Home Assistant: " + strings.Join(failed, "; "))}
+	}
+	ha.setStatus("Online")
+	return nil
+}
+
+func (ha *FNDHomeAssistantNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return ha.getConfiguration(), nil
+}
+
+func (ha *FNDHomeAssistantNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := ha.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    ha.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
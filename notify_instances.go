@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sink types registered with registerSinkType can have additional instances
+// besides the first one, which is named like the type. Additional instances
+// are named "<type>: <label>" and their configuration carries the type.
+const (
+	SINK_INSTANCE_SEPARATOR = ": "
+	SINK_INSTANCE_TYPE_KEY  = "type"
+	SINK_INSTANCE_MAX_LABEL = 40
+)
+
+type SinkInstancesPayload struct {
+	Types          []string
+	Instances      []FNDSinkInstanceLink
+	Nav            SinkInstancesNavPayload
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Doc            template.HTML
+	TranslatedText []string
+}
+
+// Registers the first instance of a sink type and remembers how to create more
+func (m *FNDNotificationManager) registerSinkType(newSink func() FNDNotificationSink) {
+	sink := newSink()
+	m.types[sink.getName()] = newSink
+	m.registerNotificationSinks(sink)
+}
+
+// Snapshot of the sinks by instance name, instances can be added and deleted while notifying
+func (m *FNDNotificationManager) sinkInstances() map[string]FNDNotificationSink {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return maps.Clone(m.sinks)
+}
+
+// Sinks report their type as name, the overview and the history show the instance
+func (m *FNDNotificationManager) instanceStatus(name string, sink FNDNotificationSink) FNDNotificationSinkStatus {
+	status := sink.getStatus()
+	status.Name = name
+	status.Queued = m.queued(name)
+	return status
+}
+
+// Starts the additional instances found in the configuration
+func (m *FNDNotificationManager) setupSinkInstances() {
+	m.m.Lock()
+	confs := maps.Clone(m.conf.Conf)
+	m.m.Unlock()
+
+	for name, conf := range confs {
+		typ := conf.Map[SINK_INSTANCE_TYPE_KEY]
+		if typ == "" || name == typ {
+			continue
+		}
+		if err := m.startSinkInstance(name, typ, conf, true); err != nil {
+			LogError("Sink instance %s setup failed: %v", name, err)
+			continue
+		}
+		LogInfo("Registered sink instance %s", name)
+	}
+}
+
+func (m *FNDNotificationManager) startSinkInstance(name, typ string, conf FNDNotificationConfigurationMap, avail bool) error {
+	newSink, ok := m.types[typ]
+	if !ok {
+		return errors.New("Sink type cannot have more instances: " + typ)
+	}
+	sink := newSink()
+	if err := sink.setup(conf, avail); err != nil {
+		return err
+	}
+	sink.getConfiguration().Map[SINK_INSTANCE_TYPE_KEY] = typ
+	sink.registerWebServer(m.web.addInstanceRouter(name, typ))
+
+	m.m.Lock()
+	m.sinks[name] = sink
+	m.conf.Conf[name] = sink.getConfiguration()
+	m.m.Unlock()
+	m.startWorker(name, sink)
+
+	m.web.addNotificationSinkStatus(m.instanceStatus(name, sink))
+	return nil
+}
+
+// Creates a disabled instance of typ named "<typ>: <label>"
+func (m *FNDNotificationManager) addSinkInstance(typ, label string) error {
+	label = strings.TrimSpace(label)
+	if _, ok := m.types[typ]; !ok {
+		return errors.New("Sink type cannot have more instances: " + typ)
+	}
+	if label == "" || len([]rune(label)) > SINK_INSTANCE_MAX_LABEL {
+		return errors.New("Name must have between 1 and 40 characters")
+	}
+	if strings.ContainsFunc(label, unicode.IsControl) {
+		return errors.New("Name must not contain control characters")
+	}
+	// routing rules separate sinks with , and conditions from sinks with ->
+	if strings.Contains(label, ",") || strings.Contains(label, ROUTING_ARROW) {
+		return errors.New("Name must not contain , or " + ROUTING_ARROW + ", routing rules could not name the instance")
+	}
+
+	name := typ + SINK_INSTANCE_SEPARATOR + label
+	m.m.Lock()
+	_, exists := m.sinks[name]
+	m.m.Unlock()
+	if exists {
+		return errors.New("Sink instance already exists: " + name)
+	}
+
+	if err := m.startSinkInstance(name, typ, NEWDefaultFNDNotificationConfigurationMap(), false); err != nil {
+		return err
+	}
+	LogInfo("Added sink instance %s", name)
+	return nil
+}
+
+// Deletes an additional instance with its configuration, the first instance of a type stays
+func (m *FNDNotificationManager) removeSinkInstance(name string) error {
+	m.m.Lock()
+	sink, ok := m.sinks[name]
+	if !ok || name == sink.getName() {
+		m.m.Unlock()
+		return errors.New("Only added sink instances can be deleted: " + name)
+	}
+	delete(m.sinks, name)
+	delete(m.conf.Conf, name)
+	m.m.Unlock()
+
+	m.stopWorker(name)
+	if _, err := sink.remove(); err != nil {
+		LogWarn("Removing sink instance %s: %v", name, err)
+	}
+	m.web.removeInstanceRouter(name)
+	m.web.removeNotificationSinkStatus(name)
+	LogInfo("Deleted sink instance %s", name)
+	return nil
+}
+
+func (m *FNDNotificationManager) registerWebServer(web *FNDWebServer) {
+	web.r.GET("/htmx/instances.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/instances.html", "templates/sink_instances.html"))
+		t.Execute(c.Writer, m.generateInstancesPayload(web.translatorFor(c), false))
+	})
+
+	web.r.POST("/htmx/instances.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		var err error
+		if name := c.PostForm("delete"); name != "" {
+			err = m.removeSinkInstance(name)
+		} else {
+			err = m.addSinkInstance(c.PostForm("type"), c.PostForm("name"))
+		}
+
+		pay := m.generateInstancesPayload(web.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/instances.html", "templates/sink_instances.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+func (m *FNDNotificationManager) generateInstancesPayload(tr Translator, postReq bool) SinkInstancesPayload {
+	links := m.web.sinkInstanceLinks()
+	types := slices.Sorted(maps.Keys(m.types))
+
+	pay := SinkInstancesPayload{
+		Types:     types,
+		Instances: links,
+		// the navigation only needs to change after a post
+		Nav: SinkInstancesNavPayload{Links: links, OOB: postReq},
+		// translations are trusted, the documentation contains markup
+		Doc: template.HTML(tr.lookupToken("sink_instances_doc")),
+		TranslatedText: []string{
+			tr.lookupToken("sink_instances"),
+			tr.lookupToken("sink_type"),
+			tr.lookupToken("instance_name"),
+			tr.lookupToken("create"),
+			tr.lookupToken("delete"),
+			tr.lookupToken("no_sink_instances"),
+			tr.lookupToken("delete_confirm"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MATRIX_TIMEOUT = 15 * time.Second
+
+type FNDMatrixNotificationSink struct {
+	FNDSinkState
+	webServer  *FNDWebServer
+	client     *http.Client
+	txnCounter atomic.Int64
+}
+
+type MatrixTemplatePayload struct {
+	Active         bool
+	Homeserver     string
+	HasToken       bool
+	UserID         string
+	Rooms          string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (matrix *FNDMatrixNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	matrix.setConfiguration(conf)
+}
+
+func (matrix *FNDMatrixNotificationSink) getName() string {
+	return "Matrix"
+}
+
+func (matrix *FNDMatrixNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		matrix.setConfiguration(conf)
+	} else {
+		matrix.createDefaultConfig()
+	}
+	matrix.client = &http.Client{Timeout: MATRIX_TIMEOUT}
+	matrix.setStatus("init")
+	return nil
+}
+
+func (matrix *FNDMatrixNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	matrix.webServer = webServer
+
+	matrix.webServer.r.GET("/htmx/matrix.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/matrix.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, matrix.generatePayload(matrix.webServer.translatorFor(c), false))
+	})
+
+	matrix.webServer.r.POST("/htmx/matrix.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := matrix.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := matrix.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, matrix.webServer.translation)
+		})
+		// checks the access token right away, so a typo shows up before the first event
+		if err == nil && matrix.getConfiguration().Map["token"] != "" {
+			err = matrix.login()
+		}
+
+		pay := matrix.generatePayload(matrix.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/matrix.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Matrix settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (matrix *FNDMatrixNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	homeserver := strings.TrimRight(strings.TrimSpace(c.PostForm("homeserver")), "/")
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	rooms := strings.TrimSpace(c.PostForm("rooms"))
+
+	if homeserver != "" {
+		if err := validateSinkURL(homeserver); err != nil {
+			return err
+		}
+	}
+	for _, room := range parseMatrixRooms(rooms) {
+		if (!strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#")) || !strings.Contains(room, ":") {
+			return errors.New("Not a room ID (!id:server) or alias (#alias:server): " + room)
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if homeserver != "" {
+		conf.Map["homeserver"] = homeserver
+	}
+	if token != "" {
+		conf.Map["token"] = token
+		delete(conf.Map, "user_id")
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+		delete(conf.Map, "user_id")
+	}
+	conf.Map["rooms"] = rooms
+	return nil
+}
+
+func (matrix *FNDMatrixNotificationSink) generatePayload(tr Translator, postReq bool) MatrixTemplatePayload {
+	conf := matrix.getConfiguration()
+	pay := MatrixTemplatePayload{
+		Active:     conf.enabled(),
+		Homeserver: conf.Map["homeserver"],
+		HasToken:   conf.Map["token"] != "",
+		UserID:     conf.Map["user_id"],
+		Rooms:      conf.Map["rooms"],
+		Templates:  generateSinkTemplatePayload(matrix.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("matrix_doc"),
+			tr.lookupToken("homeserver"),
+			tr.lookupToken("access_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("rooms"),
+			tr.lookupToken("logged_in_as"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Rooms are separated by commas or newlines
+func parseMatrixRooms(text string) []string {
+	var rooms []string
+	for _, room := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		room = strings.TrimSpace(room)
+		if room != "" {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// Calls the client server API with the access token and decodes the JSON reply into reply
+func (matrix *FNDMatrixNotificationSink) request(ctx context.Context, method string, path string, contentType string, body []byte, reply any) error {
+	conf := matrix.getConfiguration()
+	req, err := http.NewRequestWithContext(ctx, method, conf.Map["homeserver"]+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Map["token"])
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := matrix.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var matrixErr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(data, &matrixErr)
+		return errors.New("Matrix statuscode: " + strconv.Itoa(resp.StatusCode) + " " + matrixErr.ErrCode + " " + matrixErr.Error)
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.Unmarshal(data, reply)
+}
+
+// Checks the access token and remembers whom it belongs to
+func (matrix *FNDMatrixNotificationSink) login() error {
+	conf := matrix.getConfiguration()
+	if conf.Map["homeserver"] == "" {
+		return errors.New("Homeserver is empty!")
+	}
+
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	err := matrix.request(context.Background(), http.MethodGet, "/_matrix/client/v3/account/whoami", "", nil, &whoami)
+	if err != nil {
+		matrix.setStatus(err.Error())
+		return err
+	}
+	matrix.setStatus("Online")
+	return matrix.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+		conf.Map["user_id"] = whoami.UserID
+		return nil
+	})
+}
+
+// Aliases (#alias:server) are resolved to room IDs, room IDs are returned as they are
+func (matrix *FNDMatrixNotificationSink) roomID(ctx context.Context, room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+
+	var directory struct {
+		RoomID string `json:"room_id"`
+	}
+	err := matrix.request(ctx, http.MethodGet, "/_matrix/client/v3/directory/room/"+url.PathEscape(room), "", nil, &directory)
+	return directory.RoomID, err
+}
+
+func (matrix *FNDMatrixNotificationSink) sendMessage(ctx context.Context, roomID string, content any) error {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	txnID := "fnd-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + strconv.FormatInt(matrix.txnCounter.Add(1), 10)
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + txnID
+	return matrix.request(ctx, http.MethodPut, path, "application/json", body, nil)
+}
+
+// Uploads the snapshot once and posts it as m.image followed by the text to every room
+func (matrix *FNDMatrixNotificationSink) sendNotification(n FNDNotification) error {
+	conf := matrix.getConfiguration()
+	if !conf.enabled() {
+		matrix.setStatus("disabled")
+		return nil
+	}
+	rooms := parseMatrixRooms(conf.Map["rooms"])
+	if conf.Map["homeserver"] == "" || conf.Map["token"] == "" || len(rooms) == 0 {
+		matrix.setStatus("Homeserver, token or rooms are empty!")
+		return errors.New("Homeserver, token or rooms are empty!")
+	}
+
+	// up to three requests per room, all of them end at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), SINK_REQUEST_DEADLINE)
+	defer cancel()
+
+	var upload struct {
+		ContentURI string `json:"content_uri"`
+	}
+	err := matrix.request(ctx, http.MethodPost, "/_matrix/media/v3/upload?filename=snapshot.jpg", "image/jpeg", n.JpegData, &upload)
+	if err != nil {
+		matrix.setStatus(err.Error())
+		return errors.New("Matrix upload: " + err.Error())
+	}
+
+	image := map[string]any{
+		"msgtype": "m.image",
+		"body":    "snapshot.jpg",
+		"url":     upload.ContentURI,
+		"info": map[string]any{
+			"mimetype": "image/jpeg",
+			"size":     len(n.JpegData),
+		},
+	}
+	text := map[string]any{
+		"msgtype":        "m.text",
+		"body":           n.Title + "\n" + n.Caption,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<strong>" + htmltemplate.HTMLEscapeString(n.Title) + "</strong><br>" + htmltemplate.HTMLEscapeString(n.Caption),
+	}
+
+	// one unreachable room must not keep the others from being notified
+	var failed, failedRooms []string
+	for _, room := range rooms {
+		if !n.goesTo(room) {
+			continue
+		}
+		roomID, err := matrix.roomID(ctx, room)
+		if err == nil {
+			err = matrix.sendMessage(ctx, roomID, image)
+		}
+		if err == nil {
+			err = matrix.sendMessage(ctx, roomID, text)
+		}
+		if err != nil {
+			failed = append(failed, room+": "+err.Error())
+			failedRooms = append(failedRooms, room)
+		}
+	}
+
+	if len(failed) > 0 {
+		matrix.setStatus(strconv.Itoa(len(failed)) + "/" + strconv.Itoa(len(rooms)) + " rooms failed")
+		return &FNDFailedTargetsError{Targets: failedRooms, Err: errors.New("Matrix: " + strings.Join(failed, "; "))}
+	}
+	matrix.setStatus("Online")
+	return nil
+}
+
+func (matrix *FNDMatrixNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return matrix.getConfiguration(), nil
+}
+
+func (matrix *FNDMatrixNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := matrix.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    matrix.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MQTT_DEFAULT_TOPIC       = "fnd/notification"
+	MQTT_DEFAULT_IMAGE_TOPIC = "fnd/snapshot"
+)
+
+type FNDMqttNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	// the broker connection fnd already holds for frigate/events
+	conn *FNDFrigateConnection
+}
+
+type MqttTemplatePayload struct {
+	Active         bool
+	Topic          string
+	ImageTopic     string
+	Image          bool
+	Retain         bool
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+// JSON published on the notification topic
+type MqttNotificationPayload struct {
+	FNDNotificationRecord
+	ImageTopic string `json:"image_topic,omitempty"`
+}
+
+func (mqttSink *FNDMqttNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["topic"] = MQTT_DEFAULT_TOPIC
+	conf.Map["image_topic"] = MQTT_DEFAULT_IMAGE_TOPIC
+	conf.Map["image"] = "true"
+	conf.Map["retain"] = "false"
+	mqttSink.setConfiguration(conf)
+}
+
+func (mqttSink *FNDMqttNotificationSink) getName() string {
+	return "MQTT"
+}
+
+func (mqttSink *FNDMqttNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		mqttSink.setConfiguration(conf)
+	} else {
+		mqttSink.createDefaultConfig()
+	}
+	mqttSink.setStatus("init")
+	return nil
+}
+
+func (mqttSink *FNDMqttNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	mqttSink.webServer = webServer
+
+	mqttSink.webServer.r.GET("/htmx/mqtt.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/mqtt.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, mqttSink.generatePayload(mqttSink.webServer.translatorFor(c), false))
+	})
+
+	mqttSink.webServer.r.POST("/htmx/mqtt.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := mqttSink.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := mqttSink.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, mqttSink.webServer.translation)
+		})
+
+		pay := mqttSink.generatePayload(mqttSink.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/mqtt.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Topics to publish on must not contain wildcards
+func validateMqttTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("Topic must not contain the wildcards + or #: " + topic)
+	}
+	return nil
+}
+
+// Fills in the {camera} and {label} placeholders of a topic
+func mqttTopic(topic string, ev FNDNotificationEvent) string {
+	return strings.NewReplacer("{camera}", mqttTopicLevel(ev.Camera), "{label}", mqttTopicLevel(ev.Label)).Replace(topic)
+}
+
+// Camera and label fill one topic level, wildcards and separators are replaced
+func mqttTopicLevel(s string) string {
+	return strings.NewReplacer("+", "_", "#", "_", "/", "_").Replace(s)
+}
+
+// Reads the MQTT settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (mqttSink *FNDMqttNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	topic := strings.TrimSpace(c.PostForm("topic"))
+	imageTopic := strings.TrimSpace(c.PostForm("image_topic"))
+
+	for _, t := range []string{topic, imageTopic} {
+		if err := validateMqttTopic(t); err != nil {
+			return err
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if topic != "" {
+		conf.Map["topic"] = topic
+	}
+	if imageTopic != "" {
+		conf.Map["image_topic"] = imageTopic
+	}
+	conf.Map["image"] = strconv.FormatBool(c.PostForm("image") != "")
+	conf.Map["retain"] = strconv.FormatBool(c.PostForm("retain") != "")
+	return nil
+}
+
+func (mqttSink *FNDMqttNotificationSink) generatePayload(tr Translator, postReq bool) MqttTemplatePayload {
+	conf := mqttSink.getConfiguration()
+	pay := MqttTemplatePayload{
+		Active:     conf.enabled(),
+		Topic:      conf.Map["topic"],
+		ImageTopic: conf.Map["image_topic"],
+		Image:      conf.Map["image"] == "true",
+		Retain:     conf.Map["retain"] == "true",
+		Templates:  generateSinkTemplatePayload(mqttSink.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("mqtt_doc"),
+			tr.lookupToken("topic"),
+			tr.lookupToken("image_topic"),
+			tr.lookupToken("publish_image"),
+			tr.lookupToken("retain"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Publishes the snapshot first, so automations triggered by the JSON find it
+func (mqttSink *FNDMqttNotificationSink) sendNotification(n FNDNotification) error {
+	conf := mqttSink.getConfiguration()
+	if !conf.enabled() {
+		mqttSink.setStatus("disabled")
+		return nil
+	}
+	if mqttSink.conn == nil {
+		mqttSink.setStatus("No MQTT connection")
+		return errors.New("No MQTT connection")
+	}
+	topic := mqttTopic(conf.Map["topic"], n.Event)
+	if topic == "" {
+		mqttSink.setStatus("Topic is empty!")
+		return errors.New("Topic is empty!")
+	}
+	retain := conf.Map["retain"] == "true"
+
+	pay := MqttNotificationPayload{FNDNotificationRecord: newNotificationRecord(mqttSink.webServer, n)}
+
+	imageTopic := mqttTopic(conf.Map["image_topic"], n.Event)
+	if conf.Map["image"] == "true" && imageTopic != "" && len(n.JpegData) > 0 {
+		if err := mqttSink.conn.publish(imageTopic, retain, n.JpegData); err != nil {
+			mqttSink.setStatus(err.Error())
+			return err
+		}
+		pay.ImageTopic = imageTopic
+	}
+
+	data, err := json.Marshal(pay)
+	if err != nil {
+		return err
+	}
+	if err := mqttSink.conn.publish(topic, retain, data); err != nil {
+		mqttSink.setStatus(err.Error())
+		return err
+	}
+	mqttSink.setStatus("Online")
+	return nil
+}
+
+func (mqttSink *FNDMqttNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return mqttSink.getConfiguration(), nil
+}
+
+func (mqttSink *FNDMqttNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := mqttSink.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    mqttSink.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
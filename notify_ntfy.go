@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	NTFY_DEFAULT_SERVER   = "https://ntfy.sh"
+	NTFY_DEFAULT_PRIORITY = 3
+	NTFY_DEFAULT_CLICK    = "{{.ClipURL}}"
+	NTFY_TIMEOUT          = 10 * time.Second
+)
+
+// ntfy priorities from 1 to 5
+var ntfyPriorities = []string{"min", "low", "default", "high", "max"}
+
+type FNDNtfyNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type NtfyPriorityPayload struct {
+	Value    int
+	Name     string
+	Selected bool
+}
+
+type NtfyTemplatePayload struct {
+	Active         bool
+	Server         string
+	Topic          string
+	HasToken       bool
+	Priorities     []NtfyPriorityPayload
+	Tags           string
+	Click          string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (ntfy *FNDNtfyNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["server"] = NTFY_DEFAULT_SERVER
+	conf.Map["priority"] = strconv.Itoa(NTFY_DEFAULT_PRIORITY)
+	ntfy.setConfiguration(conf)
+}
+
+func (ntfy *FNDNtfyNotificationSink) getName() string {
+	return "ntfy"
+}
+
+func (ntfy *FNDNtfyNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		ntfy.setConfiguration(conf)
+	} else {
+		ntfy.createDefaultConfig()
+	}
+	ntfy.client = &http.Client{Timeout: NTFY_TIMEOUT}
+	ntfy.setStatus("init")
+	return nil
+}
+
+func (ntfy *FNDNtfyNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	ntfy.webServer = webServer
+
+	ntfy.webServer.r.GET("/htmx/ntfy.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/ntfy.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, ntfy.generatePayload(ntfy.webServer.translatorFor(c), false))
+	})
+
+	ntfy.webServer.r.POST("/htmx/ntfy.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := ntfy.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := ntfy.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, ntfy.webServer.translation)
+		})
+
+		pay := ntfy.generatePayload(ntfy.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/ntfy.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the ntfy settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (ntfy *FNDNtfyNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	server := strings.TrimRight(strings.TrimSpace(c.PostForm("server")), "/")
+	topic := strings.TrimSpace(c.PostForm("topic"))
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	priority := c.PostForm("priority")
+	tags := strings.TrimSpace(c.PostForm("tags"))
+	click := strings.TrimSpace(c.PostForm("click"))
+
+	if server != "" {
+		if err := validateSinkURL(server); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(topic, "/ ") {
+		return errors.New("Topic must not contain slashes or spaces")
+	}
+	if n, err := strconv.Atoi(priority); err != nil || n < 1 || n > len(ntfyPriorities) {
+		return errors.New("Priority must be between 1 and 5")
+	}
+	if click != "" {
+		if err := validateNotificationTemplate(click); err != nil {
+			return errors.New("Click URL: " + err.Error())
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if server != "" {
+		conf.Map["server"] = server
+	}
+	if topic != "" {
+		conf.Map["topic"] = topic
+	}
+	if token != "" {
+		conf.Map["token"] = token
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+	}
+	conf.Map["priority"] = priority
+	conf.Map["tags"] = tags
+	conf.Map["click"] = click
+	return nil
+}
+
+func (ntfy *FNDNtfyNotificationSink) generatePayload(tr Translator, postReq bool) NtfyTemplatePayload {
+	conf := ntfy.getConfiguration()
+	pay := NtfyTemplatePayload{
+		Active:    conf.enabled(),
+		Server:    ntfy.server(),
+		Topic:     conf.Map["topic"],
+		HasToken:  conf.Map["token"] != "",
+		Tags:      conf.Map["tags"],
+		Click:     conf.Map["click"],
+		Templates: generateSinkTemplatePayload(ntfy.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("ntfy_doc"),
+			tr.lookupToken("server"),
+			tr.lookupToken("topic"),
+			tr.lookupToken("access_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("priority"),
+			tr.lookupToken("tags"),
+			tr.lookupToken("click_url"),
+			tr.lookupToken("template_default"),
+		},
+	}
+	for i, name := range ntfyPriorities {
+		pay.Priorities = append(pay.Priorities, NtfyPriorityPayload{
+			Value:    i + 1,
+			Name:     name,
+			Selected: i+1 == ntfy.priority(),
+		})
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (ntfy *FNDNtfyNotificationSink) server() string {
+	conf := ntfy.getConfiguration()
+	if s := conf.Map["server"]; s != "" {
+		return s
+	}
+	return NTFY_DEFAULT_SERVER
+}
+
+func (ntfy *FNDNtfyNotificationSink) priority() int {
+	conf := ntfy.getConfiguration()
+	n, err := strconv.Atoi(conf.Map["priority"])
+	if err != nil || n < 1 || n > len(ntfyPriorities) {
+		return NTFY_DEFAULT_PRIORITY
+	}
+	return n
+}
+
+// ntfy takes non ASCII header values RFC 2047 encoded
+func ntfyHeader(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// Publishes the snapshot as attachment, everything else is passed in headers
+// (see https://docs.ntfy.sh/publish/#attach-local-file)
+func (ntfy *FNDNtfyNotificationSink) sendNotification(n FNDNotification) error {
+	conf := ntfy.getConfiguration()
+	if !conf.enabled() {
+		ntfy.setStatus("disabled")
+		return nil
+	}
+	topic := conf.Map["topic"]
+	if topic == "" {
+		ntfy.setStatus("Topic is empty!")
+		return errors.New("Topic is empty!")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, ntfy.server()+"/"+topic, bytes.NewReader(n.JpegData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", ntfyHeader(n.Title))
+	// newlines are not allowed in headers, ntfy turns \n back into newlines
+	req.Header.Set("Message", ntfyHeader(strings.ReplaceAll(n.Caption, "\n", `\n`)))
+	req.Header.Set("Priority", strconv.Itoa(ntfy.priority()))
+	req.Header.Set("Filename", "snapshot.jpg")
+	if tags := conf.Map["tags"]; tags != "" {
+		req.Header.Set("Tags", ntfyHeader(tags))
+	}
+
+	click := conf.Map["click"]
+	if click == "" {
+		click = NTFY_DEFAULT_CLICK
+	}
+	clickURL, err := renderNotificationTemplate(click, n.Event, sinkTranslator(ntfy.webServer, conf))
+	if err != nil {
+		LogWarn("ntfy click URL template failed: %v", err)
+	} else if clickURL != "" {
+		req.Header.Set("Click", clickURL)
+	}
+
+	if token := conf.Map["token"]; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := ntfy.client.Do(req)
+	if err != nil {
+		ntfy.setStatus(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// ntfy explains errors in a JSON body
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		ntfy.setStatus("ntfy statuscode: " + strconv.Itoa(resp.StatusCode))
+		return errors.New("ntfy statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(body)))
+	}
+	ntfy.setStatus("Online")
+	return nil
+}
+
+func (ntfy *FNDNtfyNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return ntfy.getConfiguration(), nil
+}
+
+func (ntfy *FNDNtfyNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := ntfy.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    ntfy.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OUTBOX_FOLDER = "outbox"
+	OUTBOX_FILE   = "outbox.json"
+
+	// the delay doubles with every failed attempt up to OUTBOX_MAX_DELAY
+	OUTBOX_FIRST_DELAY = 30 * time.Second
+	OUTBOX_MAX_DELAY   = time.Hour
+	// the oldest items are dropped beyond this, failed ones stay until deleted otherwise
+	OUTBOX_MAX_ITEMS = 500
+
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENDING = "sending"
+	OUTBOX_FAILED  = "failed"
+)
+
+// A delivery to one sink that failed and is retried
+type FNDOutboxItem struct {
+	Key  string
+	Sink string
+	// without JpegData, the snapshot is a file next to the outbox
+	Notification FNDNotification
+	HasSnapshot  bool
+	Created      time.Time
+	LastAttempt  time.Time
+	NextAttempt  time.Time
+	Attempts     int
+	LastError    string
+	State        string
+}
+
+// Returned by sinks sending to several targets when some of them failed. The outbox
+// retries only these, the other targets got the notification already.
+type FNDFailedTargetsError struct {
+	Targets []string
+	Err     error
+}
+
+func (e *FNDFailedTargetsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FNDFailedTargetsError) Unwrap() error {
+	return e.Err
+}
+
+// Keeps failed deliveries in memory and persists them as JSON in folder/outbox.
+// Like the history, snapshots are written right away and the items by flush.
+type FNDOutbox struct {
+	folder string
+	conf   *FNDOutboxConfiguration
+	items  []FNDOutboxItem // oldest first
+	dirty  bool
+
+	m sync.Mutex
+}
+
+func NewFNDOutbox(folder string, conf *FNDOutboxConfiguration) (*FNDOutbox, error) {
+	o := &FNDOutbox{
+		folder: filepath.Join(folder, OUTBOX_FOLDER),
+		conf:   conf,
+	}
+
+	err := os.MkdirAll(o.folder, 0755)
+	if err != nil {
+		return o, err
+	}
+
+	data, err := os.ReadFile(o.outboxPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+
+	err = json.Unmarshal(data, &o.items)
+	if err != nil {
+		// keep the broken file for the user, flush would overwrite it
+		o.items = nil
+		corrupt := o.outboxPath() + ".corrupt-" + time.Now().Format("20060102-150405")
+		if rerr := os.Rename(o.outboxPath(), corrupt); rerr != nil {
+			return o, fmt.Errorf("%w (could not move it aside: %v)", err, rerr)
+		}
+		return o, fmt.Errorf("%w (moved to %s)", err, corrupt)
+	}
+
+	// deliveries running during the shutdown are tried again
+	for i := range o.items {
+		if o.items[i].State == OUTBOX_SENDING {
+			o.items[i].State = OUTBOX_PENDING
+		}
+	}
+	return o, nil
+}
+
+func (o *FNDOutbox) outboxPath() string {
+	return filepath.Join(o.folder, OUTBOX_FILE)
+}
+
+func (o *FNDOutbox) snapshotPath(key string) string {
+	return filepath.Join(o.folder, filepath.Base(key)+".jpg")
+}
+
+// must be called with o.m locked
+func (o *FNDOutbox) find(sink, id string) int {
+	return slices.IndexFunc(o.items, func(item FNDOutboxItem) bool {
+		return item.Sink == sink && item.Notification.ID == id
+	})
+}
+
+// must be called with o.m locked
+func (o *FNDOutbox) findKey(key string) int {
+	return slices.IndexFunc(o.items, func(item FNDOutboxItem) bool {
+		return item.Key == key
+	})
+}
+
+// must be called with o.m locked
+func (o *FNDOutbox) removeAt(i int) {
+	if o.items[i].HasSnapshot {
+		err := os.Remove(o.snapshotPath(o.items[i].Key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			LogWarn("Could not remove outbox snapshot of %s: %v", o.items[i].Notification.ID, err)
+		}
+	}
+	o.items = slices.Delete(o.items, i, i+1)
+	o.dirty = true
+}
+
+func outboxDelay(attempts int) time.Duration {
+	delay := OUTBOX_FIRST_DELAY
+	for i := 1; i < attempts && delay < OUTBOX_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	return min(delay, OUTBOX_MAX_DELAY)
+}
+
+// Adds a failed delivery or schedules the next attempt of one already in the outbox.
+// Items older than MaxAgeHours are given up and only retried manually.
+func (o *FNDOutbox) failed(sink string, n FNDNotification, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var failedTargets *FNDFailedTargetsError
+	if errors.As(err, &failedTargets) {
+		n.Targets = failedTargets.Targets
+	}
+
+	now := time.Now()
+	i := o.find(sink, n.ID)
+	if i < 0 {
+		item := FNDOutboxItem{
+			Key:     strconv.FormatInt(now.UnixNano(), 36),
+			Sink:    sink,
+			Created: now,
+		}
+		if len(n.JpegData) > 0 {
+			werr := os.WriteFile(o.snapshotPath(item.Key), n.JpegData, 0644)
+			if werr != nil {
+				LogWarn("Could not save outbox snapshot of %s: %v", n.ID, werr)
+			}
+			item.HasSnapshot = werr == nil
+		}
+		n.JpegData = nil
+		item.Notification = n
+		o.items = append(o.items, item)
+		i = len(o.items) - 1
+	}
+
+	item := &o.items[i]
+	item.Notification.Targets = n.Targets
+	item.Attempts++
+	item.LastAttempt = now
+	item.LastError = err.Error()
+	item.State = OUTBOX_PENDING
+	item.NextAttempt = now.Add(outboxDelay(item.Attempts))
+	if now.Sub(item.Created) >= time.Duration(o.conf.MaxAgeHours)*time.Hour {
+		item.State = OUTBOX_FAILED
+		LogWarn("Giving up delivery of %s to %s after %d attempts", n.ID, sink, item.Attempts)
+	}
+	o.dirty = true
+
+	for len(o.items) > OUTBOX_MAX_ITEMS {
+		o.removeAt(0)
+	}
+}
+
+// Removes the delivery of id to sink, if it was in the outbox
+func (o *FNDOutbox) delivered(sink, id string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if i := o.find(sink, id); i >= 0 {
+		o.removeAt(i)
+	}
+}
+
+// Like delivered, for a delivery given up before it succeeded. An item that is
+// being retried already is left to that attempt.
+func (o *FNDOutbox) deliveredLate(sink, id string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if i := o.find(sink, id); i >= 0 && o.items[i].State != OUTBOX_SENDING {
+		o.removeAt(i)
+	}
+}
+
+func (o *FNDOutbox) remove(key string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	i := o.findKey(key)
+	if i < 0 {
+		return errors.New("Unknown outbox item: " + key)
+	}
+	o.removeAt(i)
+	return nil
+}
+
+// must be called with o.m locked, returns a copy with the snapshot
+func (o *FNDOutbox) send(i int) FNDOutboxItem {
+	o.items[i].State = OUTBOX_SENDING
+	o.dirty = true
+
+	item := o.items[i]
+	if item.HasSnapshot {
+		jpeg, err := os.ReadFile(o.snapshotPath(item.Key))
+		if err != nil {
+			LogWarn("Could not read outbox snapshot of %s: %v", item.Notification.ID, err)
+		}
+		item.Notification.JpegData = jpeg
+	}
+	return item
+}
+
+// Marks the pending items whose next attempt is due as sending and returns them
+func (o *FNDOutbox) due() []FNDOutboxItem {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var due []FNDOutboxItem
+	now := time.Now()
+	for i, item := range o.items {
+		if item.State == OUTBOX_PENDING && !item.NextAttempt.After(now) {
+			due = append(due, o.send(i))
+		}
+	}
+	return due
+}
+
+// Manual retry, also of items given up already
+func (o *FNDOutbox) retry(key string) (FNDOutboxItem, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	i := o.findKey(key)
+	if i < 0 {
+		return FNDOutboxItem{}, errors.New("Unknown outbox item: " + key)
+	}
+	if o.items[i].State == OUTBOX_SENDING {
+		return FNDOutboxItem{}, errors.New("Delivery is already running")
+	}
+	return o.send(i), nil
+}
+
+// Gives up an item that cannot be sent anymore, like one of a deleted sink instance
+func (o *FNDOutbox) abandon(key, reason string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if i := o.findKey(key); i >= 0 {
+		o.abandonAt(i, reason)
+	}
+}
+
+// Like abandon, for the delivery of id to sink if it is in the outbox
+func (o *FNDOutbox) abandonDelivery(sink, id, reason string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if i := o.find(sink, id); i >= 0 {
+		o.abandonAt(i, reason)
+	}
+}
+
+// must be called with o.m locked
+func (o *FNDOutbox) abandonAt(i int, reason string) {
+	o.items[i].State = OUTBOX_FAILED
+	o.items[i].LastError = reason
+	o.dirty = true
+}
+
+func (o *FNDOutbox) list() []FNDOutboxItem {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return slices.Clone(o.items)
+}
+
+// Writes the outbox to disk if anything changed
+func (o *FNDOutbox) flush() error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if !o.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(o.items)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a truncated outbox
+	tmp := o.outboxPath() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, o.outboxPath())
+	if err != nil {
+		return err
+	}
+
+	o.dirty = false
+	return nil
+}
+
+// Hands the due items to the queues of their sinks, called regularly by the BackgroundTask
+func (m *FNDNotificationManager) retryOutbox() {
+	for _, item := range m.outbox.due() {
+		m.resend(item)
+	}
+}
+
+func (m *FNDNotificationManager) resend(item FNDOutboxItem) {
+	m.m.Lock()
+	_, ok := m.workers[item.Sink]
+	m.m.Unlock()
+	if !ok {
+		m.outbox.abandon(item.Key, "Sink instance was deleted")
+		return
+	}
+
+	LogInfo("Retrying delivery of %s to %s", item.Notification.ID, item.Sink)
+	m.enqueue(item.Sink, item.Notification)
+}
+
+type OutboxPayload struct {
+	Items          []FNDOutboxItem
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Doc            template.HTML
+	TranslatedText []string
+}
+
+func (m *FNDNotificationManager) registerOutboxWebServer(web *FNDWebServer) {
+	web.r.GET("/htmx/outbox.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/outbox.html"))
+		t.Execute(c.Writer, m.generateOutboxPayload(web.translatorFor(c)))
+	})
+
+	web.r.POST("/htmx/outbox.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		var err error
+		if key := c.PostForm("delete"); key != "" {
+			err = m.outbox.remove(key)
+		} else {
+			var item FNDOutboxItem
+			item, err = m.outbox.retry(c.PostForm("retry"))
+			if err == nil {
+				m.resend(item)
+			}
+		}
+
+		pay := m.generateOutboxPayload(web.translatorFor(c))
+		pay.ShowStatus = true
+		pay.Color = "is-primary"
+		pay.StatusMessage = "OK"
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/outbox.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+func (m *FNDNotificationManager) generateOutboxPayload(tr Translator) OutboxPayload {
+	items := m.outbox.list()
+	// newest first, like the history
+	slices.Reverse(items)
+
+	return OutboxPayload{
+		Items: items,
+		// translations are trusted, the documentation contains markup
+		Doc: template.HTML(tr.lookupToken("outbox_doc")),
+		TranslatedText: []string{
+			tr.lookupToken("outbox"),
+			tr.lookupToken("time"),
+			tr.lookupToken("camera"),
+			tr.lookupToken("object"),
+			tr.lookupToken("sink"),
+			tr.lookupToken("attempts"),
+			tr.lookupToken("next_attempt"),
+			tr.lookupToken("failed"),
+			tr.lookupToken("retry"),
+			tr.lookupToken("delete"),
+			tr.lookupToken("outbox_empty"),
+			tr.lookupToken("sending"),
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutboxDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: 30 * time.Second},
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 7, want: 32 * time.Minute},
+		{attempts: 8, want: time.Hour},
+		{attempts: 9, want: time.Hour},
+		{attempts: 1000, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempts), func(t *testing.T) {
+			if got := outboxDelay(tt.attempts); got != tt.want {
+				t.Errorf("outboxDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestOutbox(t *testing.T) *FNDOutbox {
+	t.Helper()
+	o, err := NewFNDOutbox(t.TempDir(), &FNDOutboxConfiguration{MaxAgeHours: 24})
+	if err != nil {
+		t.Fatalf("NewFNDOutbox failed: %v", err)
+	}
+	return o
+}
+
+func TestOutboxFailedAndDelivered(t *testing.T) {
+	o := newTestOutbox(t)
+	n := FNDNotification{ID: "1716000000.1-abc", JpegData: []byte{0xff, 0xd8, 0xff}}
+
+	o.failed("Telegram", n, errors.New("unreachable"))
+	o.failed("Telegram", n, errors.New("still unreachable"))
+	if len(o.items) != 1 {
+		t.Fatalf("outbox has %d items after two failed attempts, want 1", len(o.items))
+	}
+	item := o.items[0]
+	if item.Attempts != 2 || item.LastError != "still unreachable" || item.State != OUTBOX_PENDING {
+		t.Errorf("item = %+v, want 2 attempts, the last error and pending", item)
+	}
+	if item.Notification.JpegData != nil || !item.HasSnapshot {
+		t.Errorf("snapshot is kept in the item instead of a file")
+	}
+	if d := item.NextAttempt.Sub(item.LastAttempt); d != outboxDelay(2) {
+		t.Errorf("next attempt after %s, want %s", d, outboxDelay(2))
+	}
+
+	o.items[0].NextAttempt = time.Now().Add(-time.Second)
+	due := o.due()
+	if len(due) != 1 || !reflect.DeepEqual(due[0].Notification.JpegData, n.JpegData) {
+		t.Fatalf("due = %+v, want the item with its snapshot", due)
+	}
+	if o.items[0].State != OUTBOX_SENDING {
+		t.Errorf("state of a due item = %s, want %s", o.items[0].State, OUTBOX_SENDING)
+	}
+
+	o.deliveredLate("Telegram", n.ID)
+	if len(o.items) != 1 {
+		t.Errorf("deliveredLate removed an item that is being sent")
+	}
+
+	snapshot := o.snapshotPath(item.Key)
+	o.delivered("Telegram", n.ID)
+	if len(o.items) != 0 {
+		t.Errorf("outbox has %d items after the delivery, want 0", len(o.items))
+	}
+	if _, err := os.Stat(snapshot); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("snapshot of a delivered item is left behind: %v", err)
+	}
+}
+
+func TestOutboxFailedTargets(t *testing.T) {
+	o := newTestOutbox(t)
+	n := FNDNotification{ID: "1716000000.1-abc"}
+
+	err := fmt.Errorf("delivery: %w", &FNDFailedTargetsError{Targets: []string{"#b:example.org"}, Err: errors.New("Matrix: #b:example.org: 502")})
+	o.failed("Matrix", n, err)
+	retry := o.items[0].Notification
+	if !reflect.DeepEqual(retry.Targets, []string{"#b:example.org"}) {
+		t.Fatalf("targets of the retry = %v, want the failed one", retry.Targets)
+	}
+	if retry.goesTo("#a:example.org") || !retry.goesTo("#b:example.org") {
+		t.Errorf("retry goes to targets that got the notification already")
+	}
+
+	// the retry fails completely, it still goes to the failed target only
+	o.failed("Matrix", retry, errors.New("Matrix upload: 502"))
+	if got := o.items[0].Notification.Targets; !reflect.DeepEqual(got, []string{"#b:example.org"}) {
+		t.Errorf("targets after a failed retry = %v, want the failed one", got)
+	}
+
+	if !n.goesTo("#a:example.org") {
+		t.Errorf("a notification without targets does not go to all of them")
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	o := newTestOutbox(t)
+	n := FNDNotification{ID: "1716000000.1-abc"}
+
+	o.failed("Gotify", n, errors.New("unreachable"))
+	o.items[0].Created = time.Now().Add(-25 * time.Hour)
+	o.failed("Gotify", n, errors.New("unreachable"))
+	if o.items[0].State != OUTBOX_FAILED {
+		t.Errorf("state of an item older than MaxAgeHours = %s, want %s", o.items[0].State, OUTBOX_FAILED)
+	}
+
+	o.items[0].NextAttempt = time.Now().Add(-time.Second)
+	if due := o.due(); len(due) != 0 {
+		t.Errorf("due returned %d items given up already", len(due))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One line of a priority rule list, like "*/person: 8" or "garden/person 22:00-06:00: 2".
+// Camera and label may be "*". Without a time window the rule applies all day.
+type FNDPriorityRule struct {
+	Camera   string
+	Label    string
+	From     int // minutes since midnight
+	To       int // minutes since midnight, From == To means all day
+	Priority int
+}
+
+// Parses one rule per line, empty lines and lines starting with # are ignored.
+// Priorities outside of lowest and highest are rejected.
+func parsePriorityRules(text string, lowest int, highest int) ([]FNDPriorityRule, error) {
+	var rules []FNDPriorityRule
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// the time window contains colons as well, the priority comes after the last one
+		sep := strings.LastIndex(line, ":")
+		if sep < 0 {
+			return nil, errors.New("Missing priority in rule: " + line)
+		}
+		prio, err := strconv.Atoi(strings.TrimSpace(line[sep+1:]))
+		if err != nil || prio < lowest || prio > highest {
+			return nil, fmt.Errorf("Priority must be between %d and %d in rule: %s", lowest, highest, line)
+		}
+
+		fields := strings.Fields(line[:sep])
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("Invalid rule: " + line)
+		}
+		camera, label, found := strings.Cut(fields[0], "/")
+		if !found || camera == "" || label == "" {
+			return nil, errors.New("Rule must start with camera/label: " + line)
+		}
+
+		rule := FNDPriorityRule{Camera: camera, Label: label, Priority: prio}
+		if len(fields) == 2 {
+			rule.From, rule.To, err = parseTimeWindow(fields[1])
+			if err != nil {
+				return nil, errors.New(err.Error() + " in rule: " + line)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Parses "22:00-06:00" into minutes since midnight
+func parseTimeWindow(s string) (int, int, error) {
+	fromText, toText, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, errors.New("Time window must look like 22:00-06:00")
+	}
+	from, err := time.Parse("15:04", fromText)
+	if err != nil {
+		return 0, 0, errors.New("Invalid time " + fromText)
+	}
+	to, err := time.Parse("15:04", toText)
+	if err != nil {
+		return 0, 0, errors.New("Invalid time " + toText)
+	}
+	return from.Hour()*60 + from.Minute(), to.Hour()*60 + to.Minute(), nil
+}
+
+func (rule FNDPriorityRule) matches(ev FNDNotificationEvent) bool {
+	if rule.Camera != "*" && rule.Camera != ev.Camera {
+		return false
+	}
+	if rule.Label != "*" && rule.Label != ev.Label {
+		return false
+	}
+	return inTimeWindow(rule.From, rule.To, ev.Time)
+}
+
+// From and To in minutes since midnight, From == To means all day
+func inTimeWindow(from int, to int, t time.Time) bool {
+	if from == to {
+		return true
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	if from < to {
+		return now >= from && now < to
+	}
+	// the window spans midnight
+	return now >= from || now < to
+}
+
+// Returns the priority of the first matching rule, def if there is none
+func priorityFor(rules []FNDPriorityRule, ev FNDNotificationEvent, def int) int {
+	for _, rule := range rules {
+		if rule.matches(ev) {
+			return rule.Priority
+		}
+	}
+	return def
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		from    int
+		to      int
+		wantErr bool
+	}{
+		{window: "08:00-17:30", from: 8 * 60, to: 17*60 + 30},
+		{window: "22:00-06:00", from: 22 * 60, to: 6 * 60},
+		{window: "00:00-00:00", from: 0, to: 0},
+		{window: "23:59-00:01", from: 23*60 + 59, to: 1},
+		{window: "22:00", wantErr: true},
+		{window: "22:00-", wantErr: true},
+		{window: "-06:00", wantErr: true},
+		{window: "25:00-06:00", wantErr: true},
+		{window: "22:00-06:60", wantErr: true},
+		{window: "night-day", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			from, to, err := parseTimeWindow(tt.window)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTimeWindow(%q) = %d, %d, want an error", tt.window, from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeWindow(%q) failed: %v", tt.window, err)
+			}
+			if from != tt.from || to != tt.to {
+				t.Errorf("parseTimeWindow(%q) = %d, %d, want %d, %d", tt.window, from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestInTimeWindow(t *testing.T) {
+	at := func(hour int, min int) time.Time {
+		return time.Date(2024, 5, 17, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name string
+		from int
+		to   int
+		t    time.Time
+		want bool
+	}{
+		{name: "all day", from: 0, to: 0, t: at(3, 0), want: true},
+		{name: "all day from == to", from: 12 * 60, to: 12 * 60, t: at(3, 0), want: true},
+		{name: "inside", from: 8 * 60, to: 17 * 60, t: at(12, 0), want: true},
+		{name: "at start", from: 8 * 60, to: 17 * 60, t: at(8, 0), want: true},
+		{name: "at end", from: 8 * 60, to: 17 * 60, t: at(17, 0), want: false},
+		{name: "before", from: 8 * 60, to: 17 * 60, t: at(7, 59), want: false},
+		{name: "after", from: 8 * 60, to: 17 * 60, t: at(20, 0), want: false},
+		{name: "over midnight evening", from: 22 * 60, to: 6 * 60, t: at(23, 30), want: true},
+		{name: "over midnight morning", from: 22 * 60, to: 6 * 60, t: at(5, 59), want: true},
+		{name: "over midnight at start", from: 22 * 60, to: 6 * 60, t: at(22, 0), want: true},
+		{name: "over midnight at end", from: 22 * 60, to: 6 * 60, t: at(6, 0), want: false},
+		{name: "over midnight day", from: 22 * 60, to: 6 * 60, t: at(12, 0), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inTimeWindow(tt.from, tt.to, tt.t); got != tt.want {
+				t.Errorf("inTimeWindow(%d, %d, %s) = %v, want %v", tt.from, tt.to, tt.t.Format("15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePriorityRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []FNDPriorityRule
+		wantErr bool
+	}{
+		{name: "empty", text: "", want: nil},
+		{
+			name: "comments and empty lines",
+			text: "# night\n\n  \n",
+			want: nil,
+		},
+		{
+			name: "all day",
+			text: "*/person: 8",
+			want: []FNDPriorityRule{{Camera: "*", Label: "person", Priority: 8}},
+		},
+		{
+			name: "time window",
+			text: "garden/person 22:00-06:00: 2",
+			want: []FNDPriorityRule{{Camera: "garden", Label: "person", From: 22 * 60, To: 6 * 60, Priority: 2}},
+		},
+		{
+			name: "several rules",
+			text: "garden/person 22:00-06:00: 10\n# cars\n  garage/car:0  \n",
+			want: []FNDPriorityRule{
+				{Camera: "garden", Label: "person", From: 22 * 60, To: 6 * 60, Priority: 10},
+				{Camera: "garage", Label: "car", Priority: 0},
+			},
+		},
+		{name: "missing priority", text: "garden/person", wantErr: true},
+		{name: "priority not a number", text: "garden/person: high", wantErr: true},
+		{name: "priority too low", text: "garden/person: -1", wantErr: true},
+		{name: "priority too high", text: "garden/person: 11", wantErr: true},
+		{name: "missing label", text: "garden: 5", wantErr: true},
+		{name: "empty camera", text: "/person: 5", wantErr: true},
+		{name: "invalid time window", text: "garden/person 22:00: 5", wantErr: true},
+		{name: "too many fields", text: "garden/person 22:00-06:00 extra: 5", wantErr: true},
+		{name: "no fields", text: ": 5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parsePriorityRules(tt.text, 0, 10)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePriorityRules(%q) = %+v, want an error", tt.text, rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePriorityRules(%q) failed: %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("parsePriorityRules(%q) = %+v, want %+v", tt.text, rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriorityFor(t *testing.T) {
+	rules := []FNDPriorityRule{
+		{Camera: "garden", Label: "person", From: 22 * 60, To: 6 * 60, Priority: 10},
+		{Camera: "*", Label: "person", Priority: 5},
+	}
+	night := time.Date(2024, 5, 17, 23, 0, 0, 0, time.Local)
+	day := time.Date(2024, 5, 17, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		ev   FNDNotificationEvent
+		want int
+	}{
+		{name: "first rule", ev: FNDNotificationEvent{Camera: "garden", Label: "person", Time: night}, want: 10},
+		{name: "outside of the window", ev: FNDNotificationEvent{Camera: "garden", Label: "person", Time: day}, want: 5},
+		{name: "any camera", ev: FNDNotificationEvent{Camera: "door", Label: "person", Time: night}, want: 5},
+		{name: "default", ev: FNDNotificationEvent{Camera: "garden", Label: "cat", Time: night}, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := priorityFor(rules, tt.ev, 3); got != tt.want {
+				t.Errorf("priorityFor(%+v) = %d, want %d", tt.ev, got, tt.want)
+			}
+		})
+	}
+}
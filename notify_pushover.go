@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PUSHOVER_API_URL = "https://api.pushover.net/1/messages.json"
+	PUSHOVER_TIMEOUT = 15 * time.Second
+
+	PUSHOVER_MIN_PRIORITY       = -2
+	PUSHOVER_EMERGENCY_PRIORITY = 2
+
+	// emergency notifications repeat every retry seconds until acknowledged or expired
+	PUSHOVER_DEFAULT_RETRY  = 60
+	PUSHOVER_MIN_RETRY      = 30
+	PUSHOVER_DEFAULT_EXPIRE = 3600
+	PUSHOVER_MAX_EXPIRE     = 10800
+)
+
+// Built in sounds, see https://pushover.net/api#sounds
+var pushoverSounds = []string{
+	"pushover", "bike", "bugle", "cashregister", "classical", "cosmic", "falling", "gamelan",
+	"incoming", "intermission", "magic", "mechanical", "pianobar", "siren", "spacealarm",
+	"tugboat", "alien", "climb", "persistent", "echo", "updown", "vibrate", "none",
+}
+
+type FNDPushoverNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type PushoverTemplatePayload struct {
+	Active         bool
+	HasToken       bool
+	User           string
+	Device         string
+	Priority       string
+	Priorities     string
+	Sound          string
+	Sounds         []string
+	Retry          string
+	Expire         string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (pushover *FNDPushoverNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["priority"] = "0"
+	conf.Map["retry"] = strconv.Itoa(PUSHOVER_DEFAULT_RETRY)
+	conf.Map["expire"] = strconv.Itoa(PUSHOVER_DEFAULT_EXPIRE)
+	pushover.setConfiguration(conf)
+}
+
+func (pushover *FNDPushoverNotificationSink) getName() string {
+	return "Pushover"
+}
+
+func (pushover *FNDPushoverNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		pushover.setConfiguration(conf)
+	} else {
+		pushover.createDefaultConfig()
+	}
+	pushover.client = &http.Client{Timeout: PUSHOVER_TIMEOUT}
+	pushover.setStatus("init")
+	return nil
+}
+
+func (pushover *FNDPushoverNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	pushover.webServer = webServer
+
+	pushover.webServer.r.GET("/htmx/pushover.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/pushover.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pushover.generatePayload(pushover.webServer.translatorFor(c), false))
+	})
+
+	pushover.webServer.r.POST("/htmx/pushover.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := pushover.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := pushover.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, pushover.webServer.translation)
+		})
+
+		pay := pushover.generatePayload(pushover.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/pushover.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Pushover settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (pushover *FNDPushoverNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	user := strings.TrimSpace(c.PostForm("user"))
+	device := strings.ReplaceAll(c.PostForm("device"), " ", "")
+	priority := strings.TrimSpace(c.PostForm("priority"))
+	priorities := strings.TrimSpace(c.PostForm("priorities"))
+	sound := c.PostForm("sound")
+	retry := strings.TrimSpace(c.PostForm("retry"))
+	expire := strings.TrimSpace(c.PostForm("expire"))
+
+	if priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil || n < PUSHOVER_MIN_PRIORITY || n > PUSHOVER_EMERGENCY_PRIORITY {
+			return errors.New("Priority must be between -2 and 2")
+		}
+	}
+	if _, err := parsePriorityRules(priorities, PUSHOVER_MIN_PRIORITY, PUSHOVER_EMERGENCY_PRIORITY); err != nil {
+		return err
+	}
+	if sound != "" && !slices.Contains(pushoverSounds, sound) {
+		return errors.New("Unknown sound: " + sound)
+	}
+	if retry != "" {
+		n, err := strconv.Atoi(retry)
+		if err != nil || n < PUSHOVER_MIN_RETRY {
+			return errors.New("Retry must be at least " + strconv.Itoa(PUSHOVER_MIN_RETRY) + " seconds")
+		}
+	}
+	if expire != "" {
+		n, err := strconv.Atoi(expire)
+		if err != nil || n < 1 || n > PUSHOVER_MAX_EXPIRE {
+			return errors.New("Expire must be between 1 and " + strconv.Itoa(PUSHOVER_MAX_EXPIRE) + " seconds")
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if token != "" {
+		conf.Map["token"] = token
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+	}
+	if user != "" {
+		conf.Map["user"] = user
+	}
+	conf.Map["device"] = device
+	if priority != "" {
+		conf.Map["priority"] = priority
+	}
+	conf.Map["priorities"] = priorities
+	conf.Map["sound"] = sound
+	if retry != "" {
+		conf.Map["retry"] = retry
+	}
+	if expire != "" {
+		conf.Map["expire"] = expire
+	}
+	return nil
+}
+
+func (pushover *FNDPushoverNotificationSink) generatePayload(tr Translator, postReq bool) PushoverTemplatePayload {
+	conf := pushover.getConfiguration()
+	pay := PushoverTemplatePayload{
+		Active:     conf.enabled(),
+		HasToken:   conf.Map["token"] != "",
+		User:       conf.Map["user"],
+		Device:     conf.Map["device"],
+		Priority:   strconv.Itoa(pushover.priority()),
+		Priorities: conf.Map["priorities"],
+		Sound:      conf.Map["sound"],
+		Sounds:     pushoverSounds,
+		Retry:      strconv.Itoa(pushover.intOption("retry", PUSHOVER_DEFAULT_RETRY)),
+		Expire:     strconv.Itoa(pushover.intOption("expire", PUSHOVER_DEFAULT_EXPIRE)),
+		Templates:  generateSinkTemplatePayload(pushover.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("pushover_doc"),
+			tr.lookupToken("app_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("user_key"),
+			tr.lookupToken("devices"),
+			tr.lookupToken("priority"),
+			tr.lookupToken("priority_rules"),
+			tr.lookupToken("sound"),
+			tr.lookupToken("default"),
+			tr.lookupToken("emergency_retry"),
+			tr.lookupToken("emergency_expire"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (pushover *FNDPushoverNotificationSink) priority() int {
+	conf := pushover.getConfiguration()
+	n, err := strconv.Atoi(conf.Map["priority"])
+	if err != nil || n < PUSHOVER_MIN_PRIORITY || n > PUSHOVER_EMERGENCY_PRIORITY {
+		return 0
+	}
+	return n
+}
+
+func (pushover *FNDPushoverNotificationSink) intOption(key string, def int) int {
+	conf := pushover.getConfiguration()
+	n, err := strconv.Atoi(conf.Map[key])
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Sends the snapshot as attachment, see https://pushover.net/api#attachments
+func (pushover *FNDPushoverNotificationSink) sendNotification(n FNDNotification) error {
+	conf := pushover.getConfiguration()
+	if !conf.enabled() {
+		pushover.setStatus("disabled")
+		return nil
+	}
+	token := conf.Map["token"]
+	user := conf.Map["user"]
+	if token == "" || user == "" {
+		pushover.setStatus("Token or user key is empty!")
+		return errors.New("Token or user key is empty!")
+	}
+
+	rules, err := parsePriorityRules(conf.Map["priorities"], PUSHOVER_MIN_PRIORITY, PUSHOVER_EMERGENCY_PRIORITY)
+	if err != nil {
+		LogWarn("Pushover priority rules ignored: %v", err)
+	}
+	priority := priorityFor(rules, n.Event, pushover.priority())
+
+	fields := map[string]string{
+		"token":     token,
+		"user":      user,
+		"title":     n.Title,
+		"message":   n.Caption,
+		"priority":  strconv.Itoa(priority),
+		"timestamp": strconv.FormatInt(n.Event.Time.Unix(), 10),
+		"url":       n.Event.ClipURL,
+		"url_title": "Frigate",
+	}
+	if device := conf.Map["device"]; device != "" {
+		fields["device"] = device
+	}
+	if sound := conf.Map["sound"]; sound != "" {
+		fields["sound"] = sound
+	}
+	if priority == PUSHOVER_EMERGENCY_PRIORITY {
+		fields["retry"] = strconv.Itoa(max(pushover.intOption("retry", PUSHOVER_DEFAULT_RETRY), PUSHOVER_MIN_RETRY))
+		fields["expire"] = strconv.Itoa(min(pushover.intOption("expire", PUSHOVER_DEFAULT_EXPIRE), PUSHOVER_MAX_EXPIRE))
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return err
+		}
+	}
+	if len(n.JpegData) > 0 {
+		fileWriter, err := writer.CreateFormFile("attachment", "snapshot.jpg")
+		if err != nil {
+			return err
+		}
+		if _, err = fileWriter.Write(n.JpegData); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, PUSHOVER_API_URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := pushover.client.Do(req)
+	if err != nil {
+		pushover.setStatus(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Status int      `json:"status"`
+		Errors []string `json:"errors"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.StatusCode != http.StatusOK || reply.Status != 1 {
+		pushover.setStatus("Pushover statuscode: " + strconv.Itoa(resp.StatusCode))
+		return errors.New("Pushover statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.Join(reply.Errors, ", "))
+	}
+	pushover.setStatus("Online")
+	return nil
+}
+
+func (pushover *FNDPushoverNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return pushover.getConfiguration(), nil
+}
+
+func (pushover *FNDPushoverNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := pushover.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    pushover.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// notifications waiting per sink, more are dropped for that sink only
+	SINK_QUEUE_SIZE = 16
+	// a delivery taking longer counts as failed, the sink's own timeouts are usually shorter
+	SINK_DELIVERY_TIMEOUT = 90 * time.Second
+	// sinks sending to several targets one after another put this deadline on all
+	// of their requests, so the delivery ends before SINK_DELIVERY_TIMEOUT
+	SINK_REQUEST_DEADLINE = 60 * time.Second
+	// deliveries still hanging after SINK_DELIVERY_TIMEOUT, further ones fail right away
+	SINK_MAX_HANGING = 2
+)
+
+// Optional for sinks delivering more than one notification at a time, like Exec.
+// As many workers as concurrency returns read from the queue of the sink.
+type FNDNotificationSinkParallel interface {
+	concurrency() int
+}
+
+// Every sink instance has its own queue and workers, so a slow or hanging
+// sink only delays its own notifications
+type FNDSinkWorker struct {
+	name  string
+	sink  FNDNotificationSink
+	queue chan FNDNotification
+	quit  chan struct{}
+	// queued and running deliveries
+	pending atomic.Int32
+	// goroutines reading from queue
+	running atomic.Int32
+	// deliveries given up after SINK_DELIVERY_TIMEOUT that did not return yet
+	hanging atomic.Int32
+}
+
+func (w *FNDSinkWorker) concurrency() int {
+	if p, ok := w.sink.(FNDNotificationSinkParallel); ok {
+		return max(p.concurrency(), 1)
+	}
+	return 1
+}
+
+func (m *FNDNotificationManager) startWorker(name string, sink FNDNotificationSink) {
+	w := &FNDSinkWorker{
+		name:  name,
+		sink:  sink,
+		queue: make(chan FNDNotification, SINK_QUEUE_SIZE),
+		quit:  make(chan struct{}),
+	}
+
+	m.m.Lock()
+	m.workers[name] = w
+	m.m.Unlock()
+
+	m.scaleWorkers(w)
+}
+
+// Starts workers up to the concurrency of the sink, it may have been raised in its settings
+func (m *FNDNotificationManager) scaleWorkers(w *FNDSinkWorker) {
+	for {
+		n := w.running.Load()
+		if int(n) >= w.concurrency() {
+			return
+		}
+		if w.running.CompareAndSwap(n, n+1) {
+			go m.work(w)
+		}
+	}
+}
+
+// Notifications still queued for a deleted instance fail, so the history and
+// the outbox do not wait for them
+func (m *FNDNotificationManager) stopWorker(name string) {
+	m.m.Lock()
+	w, ok := m.workers[name]
+	delete(m.workers, name)
+	m.m.Unlock()
+	if !ok {
+		return
+	}
+
+	close(w.quit)
+	err := errors.New("sink instance deleted")
+	for {
+		select {
+		case n := <-w.queue:
+			w.pending.Add(-1)
+			m.historyDelivery(name, w.sink, n, err)
+			m.outbox.abandonDelivery(name, n.ID, err.Error())
+		default:
+			return
+		}
+	}
+}
+
+func (m *FNDNotificationManager) queued(name string) int {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if w, ok := m.workers[name]; ok {
+		return int(w.pending.Load())
+	}
+	return 0
+}
+
+// Never blocks, a full queue drops the notification for this sink
+func (m *FNDNotificationManager) enqueue(name string, n FNDNotification) {
+	// the queue must not get new notifications once stopWorker drained it
+	m.m.Lock()
+	w, ok := m.workers[name]
+	queued := false
+	if ok {
+		w.pending.Add(1)
+		select {
+		case w.queue <- n:
+			queued = true
+		default:
+			w.pending.Add(-1)
+		}
+	}
+	m.m.Unlock()
+	if !ok {
+		return
+	}
+
+	m.scaleWorkers(w)
+	if !queued {
+		LogWarn("Queue of %s is full, dropping notification %s", name, n.ID)
+		m.recordDelivery(name, w.sink, n, errors.New("queue full, notification dropped"))
+	}
+	m.web.addNotificationSinkStatus(m.instanceStatus(name, w.sink))
+}
+
+func (m *FNDNotificationManager) work(w *FNDSinkWorker) {
+	for {
+		select {
+		case <-w.quit:
+			return
+		case n := <-w.queue:
+			m.deliver(w, n)
+		}
+
+		// the concurrency was lowered, surplus workers stop after their delivery
+		if n := w.running.Load(); int(n) > w.concurrency() && w.running.CompareAndSwap(n, n-1) {
+			return
+		}
+	}
+}
+
+func (m *FNDNotificationManager) deliver(w *FNDSinkWorker, n FNDNotification) {
+	defer func() {
+		w.pending.Add(-1)
+		m.web.addNotificationSinkStatus(m.instanceStatus(w.name, w.sink))
+	}()
+
+	sinkConf := w.sink.getConfiguration()
+	n = n.forSink(sinkConf, notificationTranslator(m.web.translation, m.web.frigateConf, sinkConf))
+
+	// the outbox retries them once the sink returns again
+	if w.hanging.Load() >= SINK_MAX_HANGING {
+		m.recordDelivery(w.name, w.sink, n, errors.New("sink is hanging, "+strconv.Itoa(SINK_MAX_HANGING)+" deliveries did not return"))
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.sink.sendNotification(n)
+	}()
+
+	select {
+	case err := <-done:
+		m.recordDelivery(w.name, w.sink, n, err)
+	case <-time.After(SINK_DELIVERY_TIMEOUT):
+		m.recordDelivery(w.name, w.sink, n, errors.New("timed out after "+SINK_DELIVERY_TIMEOUT.String()))
+		LogWarn("Delivery of %s to %s is hanging", n.ID, w.name)
+		// the worker goes on with the queue, the delivery is left to finish on its own
+		w.hanging.Add(1)
+		go m.awaitHanging(w, n, done)
+	}
+}
+
+// A late success takes the notification out of the outbox again, unless it is being retried already
+func (m *FNDNotificationManager) awaitHanging(w *FNDSinkWorker, n FNDNotification, done chan error) {
+	err := <-done
+	w.hanging.Add(-1)
+	if err != nil {
+		LogWarn("Hanging delivery of %s to %s failed: %v", n.ID, w.name, err)
+		return
+	}
+	LogInfo("Hanging delivery of %s to %s finished late", n.ID, w.name)
+	m.outbox.deliveredLate(w.name, n.ID)
+	m.historyDelivery(w.name, w.sink, n, nil)
+}
+
+// Adds the outcome of a delivery to the history, failed deliveries go to the outbox
+func (m *FNDNotificationManager) recordDelivery(name string, sink FNDNotificationSink, n FNDNotification, err error) {
+	if err != nil {
+		LogError("%s: %v", name, err)
+	}
+
+	// disabled sinks ignore the notification, only the trace needs to know
+	if !sink.getConfiguration().enabled() {
+		// nobody waits for retries of a sink disabled meanwhile
+		m.outbox.delivered(name, n.ID)
+		m.history.update(n.ID, func(entry *FNDHistoryEntry) {
+			entry.addStep(STEP_SINK, false, name+": disabled")
+		})
+		return
+	}
+	if err != nil {
+		m.outbox.failed(name, n, err)
+	} else {
+		m.outbox.delivered(name, n.ID)
+	}
+	m.historyDelivery(name, sink, n, err)
+}
+
+func (m *FNDNotificationManager) historyDelivery(name string, sink FNDNotificationSink, n FNDNotification, err error) {
+	d := FNDHistoryDelivery{
+		Sink:    name,
+		Good:    err == nil,
+		Message: sink.getStatus().Message,
+		Time:    time.Now(),
+	}
+	if err != nil {
+		d.Message = err.Error()
+	}
+	m.history.addDelivery(n.ID, d)
+	m.history.update(n.ID, func(entry *FNDHistoryEntry) {
+		entry.addStep(STEP_SINK, d.Good, name+": "+d.Message)
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Routing rules send a notification to some sink instances only, one rule per line like
+// "garage/car -> MQTT" or "front/person zone=door mode=away 22:00-06:00 -> Telegram, Pushover".
+// Camera and label may be "*". The first matching rule wins, a rule without sinks drops
+// the notification and without a matching rule every sink gets it.
+type FNDRoutingRule struct {
+	Camera string
+	Label  string
+	// the object is in or entered one of the zones when the notification is sent
+	Zones []string `json:",omitempty"`
+	Modes []string `json:",omitempty"`
+	// like "22:00-06:00", empty means all day
+	Time  string `json:",omitempty"`
+	Sinks []string
+}
+
+const ROUTING_ARROW = "->"
+
+// Modes are single words, so they can be listed in rules
+var routingModePattern = regexp.MustCompile(`^[a-z0-9_-]*$`)
+
+func normalizeMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if !routingModePattern.MatchString(mode) {
+		return "", errors.New("Mode may only contain letters, digits, - and _: " + mode)
+	}
+	return mode, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Parses one rule per line, empty lines and lines starting with # are ignored
+func parseRoutingRules(text string) ([]FNDRoutingRule, error) {
+	var rules []FNDRoutingRule
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		conditions, sinks, found := strings.Cut(line, ROUTING_ARROW)
+		if !found {
+			return nil, errors.New("Missing " + ROUTING_ARROW + " and sinks in rule: " + line)
+		}
+		fields := strings.Fields(conditions)
+		if len(fields) == 0 {
+			return nil, errors.New("Invalid rule: " + line)
+		}
+		camera, label, found := strings.Cut(fields[0], "/")
+		if !found || camera == "" || label == "" {
+			return nil, errors.New("Rule must start with camera/label: " + line)
+		}
+
+		rule := FNDRoutingRule{Camera: camera, Label: label, Sinks: splitList(sinks)}
+		if rule.Sinks == nil {
+			// written as [] instead of null, the rule drops the notification on purpose
+			rule.Sinks = []string{}
+		}
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "zone="):
+				rule.Zones = splitList(strings.TrimPrefix(field, "zone="))
+			case strings.HasPrefix(field, "mode="):
+				for _, mode := range splitList(strings.TrimPrefix(field, "mode=")) {
+					mode, err := normalizeMode(mode)
+					if err != nil {
+						return nil, errors.New(err.Error() + " in rule: " + line)
+					}
+					rule.Modes = append(rule.Modes, mode)
+				}
+			case strings.Contains(field, "="):
+				return nil, errors.New("Unknown condition " + field + " in rule: " + line)
+			default:
+				if _, _, err := parseTimeWindow(field); err != nil {
+					return nil, errors.New(err.Error() + " in rule: " + line)
+				}
+				rule.Time = field
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule FNDRoutingRule) String() string {
+	parts := []string{rule.Camera + "/" + rule.Label}
+	if len(rule.Zones) > 0 {
+		parts = append(parts, "zone="+strings.Join(rule.Zones, ","))
+	}
+	if len(rule.Modes) > 0 {
+		parts = append(parts, "mode="+strings.Join(rule.Modes, ","))
+	}
+	if rule.Time != "" {
+		parts = append(parts, rule.Time)
+	}
+	parts = append(parts, ROUTING_ARROW)
+	if len(rule.Sinks) > 0 {
+		parts = append(parts, strings.Join(rule.Sinks, ", "))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatRoutingRules(rules []FNDRoutingRule) string {
+	lines := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		lines = append(lines, rule.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (rule FNDRoutingRule) matches(ev FNDNotificationEvent, mode string) bool {
+	if rule.Camera != "*" && rule.Camera != ev.Camera {
+		return false
+	}
+	if rule.Label != "*" && rule.Label != ev.Label {
+		return false
+	}
+	if len(rule.Zones) > 0 && !slices.ContainsFunc(ev.Zones, func(zone string) bool { return slices.Contains(rule.Zones, zone) }) {
+		return false
+	}
+	if len(rule.Modes) > 0 && !slices.Contains(rule.Modes, mode) {
+		return false
+	}
+	if rule.Time == "" {
+		return true
+	}
+	// validated when the rules were saved, a broken window from the file never matches
+	from, to, err := parseTimeWindow(rule.Time)
+	return err == nil && inTimeWindow(from, to, ev.Time)
+}
+
+// Returns the first matching rule, false if there is none and every sink gets the notification
+func (m *FNDNotificationManager) route(ev FNDNotificationEvent) (FNDRoutingRule, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, rule := range m.conf.Rules {
+		if rule.matches(ev, m.conf.Mode) {
+			return rule, true
+		}
+	}
+	return FNDRoutingRule{}, false
+}
+
+// Sinks named in rules must exist. Instances deleted later are skipped by the rules and
+// reported in the history, they may stay in the rules until the user changes them.
+func (m *FNDNotificationManager) setRoutingRules(text string, mode string) error {
+	rules, err := parseRoutingRules(text)
+	if err != nil {
+		return err
+	}
+	mode, err = normalizeMode(mode)
+	if err != nil {
+		return err
+	}
+
+	sinks := m.sinkInstances()
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, rule := range rules {
+		for _, sink := range rule.Sinks {
+			if _, ok := sinks[sink]; !ok && !m.ruleSink(sink) {
+				return errors.New("Unknown sink in rule: " + sink)
+			}
+		}
+	}
+	m.conf.Rules = rules
+	m.conf.Mode = mode
+	return nil
+}
+
+// Whether the saved rules name sink, must be called with m.m locked
+func (m *FNDNotificationManager) ruleSink(sink string) bool {
+	return slices.ContainsFunc(m.conf.Rules, func(rule FNDRoutingRule) bool { return slices.Contains(rule.Sinks, sink) })
+}
+
+func (m *FNDNotificationManager) setMode(mode string) error {
+	mode, err := normalizeMode(mode)
+	if err != nil {
+		return err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.conf.Mode = mode
+	return nil
+}
+
+func (m *FNDNotificationManager) getMode() string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.conf.Mode
+}
+
+type RoutingPayload struct {
+	Rules          string
+	Mode           string
+	Modes          []string
+	Sinks          []string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Doc            template.HTML
+	TranslatedText []string
+}
+
+func (m *FNDNotificationManager) registerRoutingWebServer(web *FNDWebServer) {
+	web.r.GET("/htmx/routing.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/routing.html"))
+		t.Execute(c.Writer, m.generateRoutingPayload(web.translatorFor(c), false))
+	})
+
+	web.r.POST("/htmx/routing.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		rules := c.PostForm("rules")
+		err := m.setRoutingRules(rules, c.PostForm("mode"))
+
+		pay := m.generateRoutingPayload(web.translatorFor(c), true)
+		if err != nil {
+			// keep the input, it is probably only one typo away from being valid
+			pay.Rules = rules
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/routing.html"))
+		t.Execute(c.Writer, pay)
+	})
+
+	// For automations switching between home and away
+	web.r.GET("/api/mode", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"mode": m.getMode()})
+	})
+	web.r.POST("/api/mode", func(c *gin.Context) {
+		if err := m.setMode(c.PostForm("mode")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		LogInfo("Notification mode changed to %q", m.getMode())
+		c.JSON(http.StatusOK, gin.H{"mode": m.getMode()})
+	})
+}
+
+func (m *FNDNotificationManager) generateRoutingPayload(tr Translator, postReq bool) RoutingPayload {
+	m.m.Lock()
+	rules := m.conf.Rules
+	mode := m.conf.Mode
+	m.m.Unlock()
+
+	var modes []string
+	for _, rule := range rules {
+		for _, ruleMode := range rule.Modes {
+			if !slices.Contains(modes, ruleMode) {
+				modes = append(modes, ruleMode)
+			}
+		}
+	}
+
+	sinks := make([]string, 0)
+	for name := range m.sinkInstances() {
+		sinks = append(sinks, name)
+	}
+	slices.Sort(sinks)
+
+	pay := RoutingPayload{
+		Rules: formatRoutingRules(rules),
+		Mode:  mode,
+		Modes: modes,
+		Sinks: sinks,
+		// translations are trusted, the documentation contains markup
+		Doc: template.HTML(tr.lookupToken("routing_doc")),
+		TranslatedText: []string{
+			tr.lookupToken("routing"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("mode"),
+			tr.lookupToken("routing_rules"),
+			tr.lookupToken("available_sinks"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
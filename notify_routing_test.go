@@ -0,0 +1,217 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRoutingRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []FNDRoutingRule
+		wantErr bool
+	}{
+		{name: "empty", text: "", want: nil},
+		{name: "comments and empty lines", text: "# routing\n\n   \n", want: nil},
+		{
+			name: "one sink",
+			text: "garage/car -> MQTT",
+			want: []FNDRoutingRule{{Camera: "garage", Label: "car", Sinks: []string{"MQTT"}}},
+		},
+		{
+			name: "all conditions",
+			text: "front/person zone=door,drive mode=Away 22:00-06:00 -> Telegram, Pushover",
+			want: []FNDRoutingRule{{
+				Camera: "front",
+				Label:  "person",
+				Zones:  []string{"door", "drive"},
+				Modes:  []string{"away"},
+				Time:   "22:00-06:00",
+				Sinks:  []string{"Telegram", "Pushover"},
+			}},
+		},
+		{
+			name: "drop",
+			text: "*/cat ->",
+			want: []FNDRoutingRule{{Camera: "*", Label: "cat", Sinks: []string{}}},
+		},
+		{
+			name: "several rules",
+			text: "  garage/car -> MQTT  \n# night\n*/* 22:00-06:00 -> Telegram,\n",
+			want: []FNDRoutingRule{
+				{Camera: "garage", Label: "car", Sinks: []string{"MQTT"}},
+				{Camera: "*", Label: "*", Time: "22:00-06:00", Sinks: []string{"Telegram"}},
+			},
+		},
+		{name: "missing arrow", text: "garage/car MQTT", wantErr: true},
+		{name: "missing conditions", text: "-> MQTT", wantErr: true},
+		{name: "missing label", text: "garage -> MQTT", wantErr: true},
+		{name: "empty label", text: "garage/ -> MQTT", wantErr: true},
+		{name: "unknown condition", text: "garage/car score=0.8 -> MQTT", wantErr: true},
+		{name: "invalid mode", text: "garage/car mode=on.vacation -> MQTT", wantErr: true},
+		{name: "invalid time window", text: "garage/car 22:00 -> MQTT", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRoutingRules(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRoutingRules(%q) = %+v, want an error", tt.text, rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRoutingRules(%q) failed: %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("parseRoutingRules(%q) = %+v, want %+v", tt.text, rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRoutingRules(t *testing.T) {
+	text := "front/person zone=door,drive mode=away 22:00-06:00 -> Telegram, Pushover\n*/cat ->"
+	rules, err := parseRoutingRules(text)
+	if err != nil {
+		t.Fatalf("parseRoutingRules failed: %v", err)
+	}
+	if got := formatRoutingRules(rules); got != text {
+		t.Errorf("formatRoutingRules = %q, want %q", got, text)
+	}
+}
+
+func TestRoutingRuleMatches(t *testing.T) {
+	night := time.Date(2024, 5, 17, 23, 0, 0, 0, time.Local)
+	day := time.Date(2024, 5, 17, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		rule FNDRoutingRule
+		ev   FNDNotificationEvent
+		mode string
+		want bool
+	}{
+		{
+			name: "camera and label",
+			rule: FNDRoutingRule{Camera: "garage", Label: "car"},
+			ev:   FNDNotificationEvent{Camera: "garage", Label: "car"},
+			want: true,
+		},
+		{
+			name: "other camera",
+			rule: FNDRoutingRule{Camera: "garage", Label: "car"},
+			ev:   FNDNotificationEvent{Camera: "front", Label: "car"},
+			want: false,
+		},
+		{
+			name: "other label",
+			rule: FNDRoutingRule{Camera: "garage", Label: "car"},
+			ev:   FNDNotificationEvent{Camera: "garage", Label: "person"},
+			want: false,
+		},
+		{
+			name: "wildcards",
+			rule: FNDRoutingRule{Camera: "*", Label: "*"},
+			ev:   FNDNotificationEvent{Camera: "front", Label: "person"},
+			want: true,
+		},
+		{
+			name: "one of the zones",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Zones: []string{"door", "drive"}},
+			ev:   FNDNotificationEvent{Zones: []string{"yard", "drive"}},
+			want: true,
+		},
+		{
+			name: "none of the zones",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Zones: []string{"door"}},
+			ev:   FNDNotificationEvent{Zones: []string{"yard"}},
+			want: false,
+		},
+		{
+			name: "no zones of the event",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Zones: []string{"door"}},
+			ev:   FNDNotificationEvent{},
+			want: false,
+		},
+		{
+			name: "mode",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Modes: []string{"away", "night"}},
+			mode: "night",
+			want: true,
+		},
+		{
+			name: "other mode",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Modes: []string{"away"}},
+			mode: "home",
+			want: false,
+		},
+		{
+			name: "no mode set",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Modes: []string{"away"}},
+			want: false,
+		},
+		{
+			name: "inside of the time window",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Time: "22:00-06:00"},
+			ev:   FNDNotificationEvent{Time: night},
+			want: true,
+		},
+		{
+			name: "outside of the time window",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Time: "22:00-06:00"},
+			ev:   FNDNotificationEvent{Time: day},
+			want: false,
+		},
+		{
+			name: "broken time window",
+			rule: FNDRoutingRule{Camera: "*", Label: "*", Time: "22:00"},
+			ev:   FNDNotificationEvent{Time: night},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(tt.ev, tt.mode); got != tt.want {
+				t.Errorf("%s matches %+v in mode %q = %v, want %v", tt.rule, tt.ev, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	rules, err := parseRoutingRules("garage/car -> MQTT\n*/cat ->\n*/* mode=away -> Telegram, Pushover")
+	if err != nil {
+		t.Fatalf("parseRoutingRules failed: %v", err)
+	}
+	m := NewFNDNotificationManager(FNDNotificationConfiguration{Rules: rules, Mode: "away"}, nil, nil)
+
+	tests := []struct {
+		name   string
+		ev     FNDNotificationEvent
+		sinks  []string
+		routed bool
+	}{
+		{name: "first rule wins", ev: FNDNotificationEvent{Camera: "garage", Label: "car"}, sinks: []string{"MQTT"}, routed: true},
+		{name: "dropped", ev: FNDNotificationEvent{Camera: "garage", Label: "cat"}, sinks: []string{}, routed: true},
+		{name: "later rule", ev: FNDNotificationEvent{Camera: "front", Label: "person"}, sinks: []string{"Telegram", "Pushover"}, routed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, routed := m.route(tt.ev)
+			if routed != tt.routed || !reflect.DeepEqual(rule.Sinks, tt.sinks) {
+				t.Errorf("route(%+v) = %v, %v, want %v, %v", tt.ev, rule.Sinks, routed, tt.sinks, tt.routed)
+			}
+		})
+	}
+
+	m.conf.Mode = "home"
+	if rule, routed := m.route(FNDNotificationEvent{Camera: "front", Label: "person"}); routed {
+		t.Errorf("route without a matching rule = %s, want all sinks", rule)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const SIGNAL_TIMEOUT = 30 * time.Second
+
+type FNDSignalNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type SignalTemplatePayload struct {
+	Active         bool
+	Endpoint       string
+	Number         string
+	Recipients     string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+// Request body of POST /v2/send, see https://bbernhard.github.io/signal-cli-rest-api/
+type SignalMessage struct {
+	Message           string   `json:"message"`
+	Number            string   `json:"number"`
+	Recipients        []string `json:"recipients"`
+	Base64Attachments []string `json:"base64_attachments,omitempty"`
+}
+
+func (signal *FNDSignalNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["endpoint"] = "http://localhost:8080"
+	signal.setConfiguration(conf)
+}
+
+func (signal *FNDSignalNotificationSink) getName() string {
+	return "Signal"
+}
+
+func (signal *FNDSignalNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		signal.setConfiguration(conf)
+	} else {
+		signal.createDefaultConfig()
+	}
+	signal.client = &http.Client{Timeout: SIGNAL_TIMEOUT}
+	signal.setStatus("init")
+	return nil
+}
+
+func (signal *FNDSignalNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	signal.webServer = webServer
+
+	signal.webServer.r.GET("/htmx/signal.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/signal.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, signal.generatePayload(signal.webServer.translatorFor(c), false))
+	})
+
+	signal.webServer.r.POST("/htmx/signal.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := signal.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := signal.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, signal.webServer.translation)
+		})
+
+		pay := signal.generatePayload(signal.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/signal.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Phone numbers in international format like +491701234567
+func isSignalNumber(s string) bool {
+	if len(s) < 3 || s[0] != '+' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Recipients are phone numbers or group IDs (group.xxx as listed by GET /v1/groups/{number}),
+// separated by commas or newlines
+func parseSignalRecipients(text string) []string {
+	var recipients []string
+	for _, recipient := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		recipient = strings.ReplaceAll(strings.TrimSpace(recipient), " ", "")
+		if recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients
+}
+
+// Reads the Signal settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (signal *FNDSignalNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	endpoint := strings.TrimRight(strings.TrimSpace(c.PostForm("endpoint")), "/")
+	number := strings.ReplaceAll(strings.TrimSpace(c.PostForm("number")), " ", "")
+	recipients := strings.TrimSpace(c.PostForm("recipients"))
+
+	if endpoint != "" {
+		if err := validateSinkURL(endpoint); err != nil {
+			return err
+		}
+	}
+	if number != "" && !isSignalNumber(number) {
+		return errors.New("Sender must be a phone number like +491701234567")
+	}
+	for _, recipient := range parseSignalRecipients(recipients) {
+		if !isSignalNumber(recipient) && !strings.HasPrefix(recipient, "group.") {
+			return errors.New("Not a phone number or group ID (group.xxx): " + recipient)
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if endpoint != "" {
+		conf.Map["endpoint"] = endpoint
+	}
+	if number != "" {
+		conf.Map["number"] = number
+	}
+	conf.Map["recipients"] = recipients
+	return nil
+}
+
+func (signal *FNDSignalNotificationSink) generatePayload(tr Translator, postReq bool) SignalTemplatePayload {
+	conf := signal.getConfiguration()
+	pay := SignalTemplatePayload{
+		Active:     conf.enabled(),
+		Endpoint:   conf.Map["endpoint"],
+		Number:     conf.Map["number"],
+		Recipients: conf.Map["recipients"],
+		Templates:  generateSinkTemplatePayload(signal.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("signal_doc"),
+			tr.lookupToken("endpoint"),
+			tr.lookupToken("sender_number"),
+			tr.lookupToken("recipients"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Sends one message with the snapshot to all recipients
+func (signal *FNDSignalNotificationSink) sendNotification(n FNDNotification) error {
+	conf := signal.getConfiguration()
+	if !conf.enabled() {
+		signal.setStatus("disabled")
+		return nil
+	}
+	endpoint := conf.Map["endpoint"]
+	recipients := parseSignalRecipients(conf.Map["recipients"])
+	if endpoint == "" || conf.Map["number"] == "" || len(recipients) == 0 {
+		signal.setStatus("Endpoint, sender or recipients are empty!")
+		return errors.New("Endpoint, sender or recipients are empty!")
+	}
+
+	msg := SignalMessage{
+		Message:    n.Title + "\n" + n.Caption,
+		Number:     conf.Map["number"],
+		Recipients: recipients,
+	}
+	if len(n.JpegData) > 0 {
+		msg.Base64Attachments = []string{"data:image/jpeg;filename=snapshot.jpg;base64," + base64.StdEncoding.EncodeToString(n.JpegData)}
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := signal.client.Post(endpoint+"/v2/send", "application/json", bytes.NewReader(body))
+	if err != nil {
+		signal.setStatus(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var reply struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(data, &reply)
+		signal.setStatus("Signal statuscode: " + strconv.Itoa(resp.StatusCode))
+		return errors.New("Signal statuscode: " + strconv.Itoa(resp.StatusCode) + " " + reply.Error)
+	}
+	signal.setStatus("Online")
+	return nil
+}
+
+func (signal *FNDSignalNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return signal.getConfiguration(), nil
+}
+
+func (signal *FNDSignalNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := signal.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    signal.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SLACK_API_URL = "https://slack.com/api/"
+	SLACK_TIMEOUT = 15 * time.Second
+
+	// limit of a plain_text header block
+	SLACK_MAX_HEADER = 150
+	// target of the snapshot upload in a retry, the webhooks are targets by their URL
+	SLACK_SNAPSHOT_TARGET = "snapshot"
+)
+
+type FNDSlackNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+type SlackTemplatePayload struct {
+	Active         bool
+	Webhooks       string
+	HasToken       bool
+	Channels       string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type SlackBlock struct {
+	Type     string      `json:"type"`
+	Text     *SlackText  `json:"text,omitempty"`
+	Fields   []SlackText `json:"fields,omitempty"`
+	Elements []SlackText `json:"elements,omitempty"`
+}
+
+type SlackMessage struct {
+	// fallback for notifications and clients without blocks
+	Text   string       `json:"text"`
+	Blocks []SlackBlock `json:"blocks"`
+}
+
+func (slack *FNDSlackNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	slack.setConfiguration(conf)
+}
+
+func (slack *FNDSlackNotificationSink) getName() string {
+	return "Slack"
+}
+
+func (slack *FNDSlackNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		slack.setConfiguration(conf)
+	} else {
+		slack.createDefaultConfig()
+	}
+	slack.client = &http.Client{Timeout: SLACK_TIMEOUT}
+	slack.setStatus("init")
+	return nil
+}
+
+func (slack *FNDSlackNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	slack.webServer = webServer
+
+	slack.webServer.r.GET("/htmx/slack.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/slack.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, slack.generatePayload(slack.webServer.translatorFor(c), false))
+	})
+
+	slack.webServer.r.POST("/htmx/slack.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := slack.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := slack.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, slack.webServer.translation)
+		})
+
+		pay := slack.generatePayload(slack.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/slack.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Slack settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (slack *FNDSlackNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	webhooks := strings.TrimSpace(c.PostForm("webhooks"))
+	token := strings.TrimSpace(c.PostForm("token0815"))
+	channels := strings.Join(strings.Fields(strings.ReplaceAll(c.PostForm("channels"), ",", " ")), ",")
+
+	for _, webhook := range parseWebhookURLs(webhooks) {
+		if err := validateSinkURL(webhook); err != nil {
+			return errors.New(webhook + ": " + err.Error())
+		}
+	}
+	if token != "" && !strings.HasPrefix(token, "xoxb-") {
+		return errors.New("Bot token must start with xoxb-")
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	conf.Map["webhooks"] = webhooks
+	if token != "" {
+		conf.Map["token"] = token
+	}
+	if c.PostForm("clear_token") != "" {
+		delete(conf.Map, "token")
+	}
+	conf.Map["channels"] = channels
+	return nil
+}
+
+func (slack *FNDSlackNotificationSink) generatePayload(tr Translator, postReq bool) SlackTemplatePayload {
+	conf := slack.getConfiguration()
+	pay := SlackTemplatePayload{
+		Active:    conf.enabled(),
+		Webhooks:  conf.Map["webhooks"],
+		HasToken:  conf.Map["token"] != "",
+		Channels:  conf.Map["channels"],
+		Templates: generateSinkTemplatePayload(slack.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("slack_doc"),
+			tr.lookupToken("webhook_urls"),
+			tr.lookupToken("bot_token"),
+			tr.lookupToken("secret_clear"),
+			tr.lookupToken("snapshot_channels"),
+			tr.lookupToken("slack_snapshot_help"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Escapes the control characters of mrkdwn, see https://api.slack.com/reference/surfaces/formatting#escaping
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func (slack *FNDSlackNotificationSink) message(n FNDNotification) SlackMessage {
+	conf := slack.getConfiguration()
+	tr := sinkTranslator(slack.webServer, conf)
+	// Slack shows the time in the time zone of the reader, the text after | is the fallback
+	timestamp := "<!date^" + strconv.FormatInt(n.Event.Time.Unix(), 10) + "^{date_short_pretty} {time_secs}|" + n.Event.Time.Format(time.RFC3339) + ">"
+
+	// Slack rejects a header without text as invalid_blocks
+	var blocks []SlackBlock
+	if strings.TrimSpace(n.Title) != "" {
+		blocks = append(blocks, SlackBlock{Type: "header", Text: &SlackText{Type: "plain_text", Text: truncateRunes(n.Title, SLACK_MAX_HEADER)}})
+	}
+	if n.Caption != "" {
+		blocks = append(blocks, SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: slackEscape(n.Caption)}})
+	}
+	blocks = append(blocks, SlackBlock{
+		Type: "section",
+		Fields: []SlackText{
+			{Type: "mrkdwn", Text: "*" + tr.lookupToken("camera") + "*\n" + slackEscape(n.Event.Camera)},
+			{Type: "mrkdwn", Text: "*" + tr.lookupToken("object") + "*\n" + slackEscape(tr.label(n.Event.Label))},
+			{Type: "mrkdwn", Text: "*" + tr.lookupToken("score") + "*\n" + strconv.Itoa(int(n.Event.Score*100+0.5)) + "%"},
+			{Type: "mrkdwn", Text: "*" + tr.lookupToken("time") + "*\n" + timestamp},
+		},
+	})
+	if n.Event.ClipURL != "" {
+		blocks = append(blocks, SlackBlock{
+			Type:     "context",
+			Elements: []SlackText{{Type: "mrkdwn", Text: "<" + n.Event.ClipURL + "|Frigate>"}},
+		})
+	}
+
+	return SlackMessage{
+		Text:   strings.TrimSpace(n.Title + "\n" + n.Caption),
+		Blocks: blocks,
+	}
+}
+
+// Incoming webhooks answer with the plain text "ok"
+func (slack *FNDSlackNotificationSink) post(ctx context.Context, webhook string, payloadJSON []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payloadJSON))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := slack.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New("Slack statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// Calls a Web API method with the bot token, Slack reports errors with ok=false
+func (slack *FNDSlackNotificationSink) callAPI(ctx context.Context, method string, form url.Values, reply any) error {
+	conf := slack.getConfiguration()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, SLACK_API_URL+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+conf.Map["token"])
+
+	resp, err := slack.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return errors.New("Slack " + method + " statuscode: " + strconv.Itoa(resp.StatusCode))
+	}
+	if !status.OK {
+		return errors.New("Slack " + method + ": " + status.Error)
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.Unmarshal(data, reply)
+}
+
+// Shares the snapshot in the channels, see https://api.slack.com/messaging/files#uploading_files
+func (slack *FNDSlackNotificationSink) uploadSnapshot(ctx context.Context, n FNDNotification) error {
+	conf := slack.getConfiguration()
+	var upload struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	err := slack.callAPI(ctx, "files.getUploadURLExternal", url.Values{
+		"filename": {"snapshot.jpg"},
+		"length":   {strconv.Itoa(len(n.JpegData))},
+	}, &upload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL, bytes.NewReader(n.JpegData))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+
+	resp, err := slack.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Slack upload statuscode: " + strconv.Itoa(resp.StatusCode))
+	}
+
+	files, err := json.Marshal([]map[string]string{{"id": upload.FileID, "title": n.Title}})
+	if err != nil {
+		return err
+	}
+	return slack.callAPI(ctx, "files.completeUploadExternal", url.Values{
+		"files":           {string(files)},
+		"channels":        {conf.Map["channels"]},
+		"initial_comment": {n.Title},
+	}, nil)
+}
+
+// Posts the blocks to every webhook and, with a bot token, uploads the snapshot to the channels
+func (slack *FNDSlackNotificationSink) sendNotification(n FNDNotification) error {
+	conf := slack.getConfiguration()
+	if !conf.enabled() {
+		slack.setStatus("disabled")
+		return nil
+	}
+	webhooks := parseWebhookURLs(conf.Map["webhooks"])
+	canUpload := conf.Map["token"] != "" && conf.Map["channels"] != ""
+	upload := canUpload && len(n.JpegData) > 0
+	if len(webhooks) == 0 && !upload {
+		slack.setStatus("Webhook URL or bot token and channels are empty!")
+		return errors.New("Webhook URL or bot token and channels are empty!")
+	}
+
+	payloadJSON, err := json.Marshal(slack.message(n))
+	if err != nil {
+		return err
+	}
+
+	// the channels are posted one after another, all of them end at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), SINK_REQUEST_DEADLINE)
+	defer cancel()
+
+	// one broken channel must not keep the others from being notified
+	var failed, failedTargets []string
+	for i, webhook := range webhooks {
+		if !n.goesTo(webhook) {
+			continue
+		}
+		if err := slack.post(ctx, webhook, payloadJSON); err != nil {
+			failed = append(failed, "channel "+strconv.Itoa(i+1)+": "+err.Error())
+			failedTargets = append(failedTargets, webhook)
+		}
+	}
+	if upload && n.goesTo(SLACK_SNAPSHOT_TARGET) {
+		if err := slack.uploadSnapshot(ctx, n); err != nil {
+			failed = append(failed, "snapshot: "+err.Error())
+			failedTargets = append(failedTargets, SLACK_SNAPSHOT_TARGET)
+		}
+	}
+
+	if len(failed) > 0 {
+		slack.setStatus(strings.Join(failed, "; "))
+		return &FNDFailedTargetsError{Targets: failedTargets, Err: errors.New("Slack: " + strings.Join(failed, "; "))}
+	}
+	if len(n.JpegData) > 0 && !canUpload {
+		// incoming webhooks cannot upload files
+		slack.setStatus("Online, snapshot skipped: no bot token or channels")
+		return nil
+	}
+	slack.setStatus("Online")
+	return nil
+}
+
+func (slack *FNDSlackNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return slack.getConfiguration(), nil
+}
+
+func (slack *FNDSlackNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := slack.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    slack.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -15,14 +15,12 @@ import (
 )
 
 type FNDTelegramNotificationSink struct {
-	config            FNDNotificationConfigurationMap
-	webServer         *FNDWebServer
-	bot               *bot.Bot
-	ctx               context.Context
-	cancel            context.CancelFunc
-	botRunning        bool
-	chatid            int64
-	lastStatusMessage string
+	FNDSinkState
+	webServer  *FNDWebServer
+	bot        *bot.Bot
+	ctx        context.Context
+	cancel     context.CancelFunc
+	botRunning bool
 }
 
 type TelegramTemplatePayload struct {
@@ -32,12 +30,14 @@ type TelegramTemplatePayload struct {
 	ShowStatus     bool
 	Color          string
 	StatusMessage  string
+	Templates      SinkTemplatePayload
 	TranslatedText []string
 }
 
 func (tel *FNDTelegramNotificationSink) createDefaultConfig() {
-	tel.config = NEWDefaultFNDNotificationConfigurationMap()
-	tel.config.Map["enabled"] = "false"
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	tel.setConfiguration(conf)
 }
 
 func (tel *FNDTelegramNotificationSink) getName() string {
@@ -46,12 +46,7 @@ func (tel *FNDTelegramNotificationSink) getName() string {
 
 func (tel *FNDTelegramNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
 	if avail {
-		tel.config = conf
-		data, err := strconv.ParseInt(tel.config.Map["chatid"], 10, 64)
-		if err == nil {
-			tel.chatid = data
-		}
-
+		tel.setConfiguration(conf)
 	} else {
 		tel.createDefaultConfig()
 	}
@@ -59,7 +54,7 @@ func (tel *FNDTelegramNotificationSink) setup(conf FNDNotificationConfigurationM
 	if err != nil {
 		fmt.Println(err.Error())
 	}
-	tel.lastStatusMessage = "init"
+	tel.setStatus("init")
 	return nil
 }
 
@@ -68,64 +63,72 @@ func (tel *FNDTelegramNotificationSink) registerWebServer(webServer *FNDWebServe
 
 	tel.webServer.r.GET("/htmx/telegram.html", func(c *gin.Context) {
 
-		t := template.Must(template.ParseFS(templateFS, "templates/telegram.html"))
-		t.Execute(c.Writer, tel.generatePayload(false))
+		t := template.Must(template.ParseFS(templateFS, "templates/telegram.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, tel.generatePayload(tel.webServer.translatorFor(c), false))
 	})
 
 	tel.webServer.r.POST("/htmx/telegram.html", func(c *gin.Context) {
 
-		lastToken := tel.config.Map["token"]
+		lastToken := tel.getConfiguration().Map["token"]
 
-		tel.config.Map["enabled"] = "false"
 		c.MultipartForm()
-		for key, value := range c.Request.PostForm {
-			if key == "token0815" {
-				if value[0] == "" {
+		templateErr := tel.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			conf.Map["enabled"] = "false"
+			for key, value := range c.Request.PostForm {
+				if key == "token0815" {
+					if value[0] == "" {
+						continue
+					}
+					conf.Map["token"] = value[0]
 					continue
 				}
-				tel.config.Map["token"] = value[0]
-				continue
-			}
-			if key == "chatid" {
-				if value[0] == "" {
+				if key == "chatid" {
+					if value[0] == "" {
+						continue
+					}
+					if _, err := strconv.ParseInt(value[0], 10, 64); err != nil {
+						continue
+					}
+					conf.Map["chatid"] = value[0]
 					continue
 				}
-				data, err := strconv.ParseInt(value[0], 10, 64)
-				if err != nil {
-					continue
-				}
-				tel.config.Map["chatid"] = value[0]
-				tel.chatid = data
-				continue
-			}
-			if key == "aktiv" {
-				if value[0] == "" {
+				if key == "aktiv" {
+					if value[0] == "" {
+						continue
+					}
+					conf.Map["enabled"] = "true"
 					continue
 				}
-				tel.config.Map["enabled"] = "true"
-				continue
 			}
-		}
+			return applyTemplateForm(c, conf, tel.webServer.translation)
+		})
 
+		conf := tel.getConfiguration()
 		if !tel.botRunning {
-			if tel.config.Map["enabled"] == "true" {
+			if conf.Map["enabled"] == "true" {
 				err := tel.botStart()
 				if err != nil {
 					fmt.Println(err.Error())
 				}
 			}
 		} else {
-			if tel.config.Map["enabled"] == "false" {
+			if conf.Map["enabled"] == "false" {
 				tel.botStop()
 			} else {
-				if lastToken != tel.config.Map["token"] {
+				if lastToken != conf.Map["token"] {
 					go tel.gracefulBotRestart()
 				}
 			}
 		}
 
-		t := template.Must(template.ParseFS(templateFS, "templates/telegram.html"))
-		t.Execute(c.Writer, tel.generatePayload(true))
+		pay := tel.generatePayload(tel.webServer.translatorFor(c), true)
+		if templateErr != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = templateErr.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/telegram.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
 	})
 
 }
@@ -136,8 +139,9 @@ func (tel *FNDTelegramNotificationSink) gracefulBotRestart() {
 	tel.botStart()
 }
 
-func (tel *FNDTelegramNotificationSink) generatePayload(postReq bool) TelegramTemplatePayload {
-	en, _ := tel.config.Map["enabled"]
+func (tel *FNDTelegramNotificationSink) generatePayload(tr Translator, postReq bool) TelegramTemplatePayload {
+	conf := tel.getConfiguration()
+	en, _ := conf.Map["enabled"]
 	var en_bool bool
 	if en == "" || en == "false" {
 		en_bool = false
@@ -146,13 +150,14 @@ func (tel *FNDTelegramNotificationSink) generatePayload(postReq bool) TelegramTe
 	}
 
 	pay := TelegramTemplatePayload{
-		Active: en_bool,
-		Token:  tel.config.Map["token"],
-		ChatID: tel.config.Map["chatid"],
+		Active:    en_bool,
+		Token:     conf.Map["token"],
+		ChatID:    conf.Map["chatid"],
+		Templates: generateSinkTemplatePayload(tel.webServer, tr, conf, postReq),
 		TranslatedText: []string{
-			tel.webServer.translation.lookupToken("active"),
-			tel.webServer.translation.lookupToken("apply"),
-			tel.webServer.translation.lookupToken("tel_doc"),
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("tel_doc"),
 		},
 	}
 
@@ -168,48 +173,51 @@ func (tel *FNDTelegramNotificationSink) generatePayload(postReq bool) TelegramTe
 }
 
 func (tel *FNDTelegramNotificationSink) sendNotification(n FNDNotification) error {
-	if tel.config.Map["enabled"] != "true" {
-		tel.lastStatusMessage = "disabeled"
+	conf := tel.getConfiguration()
+	if conf.Map["enabled"] != "true" {
+		tel.setStatus("disabeled")
 		return nil
 	}
-	if tel.config.Map["token"] == "" {
-		tel.lastStatusMessage = "Bot token is empty!"
+	if conf.Map["token"] == "" {
+		tel.setStatus("Bot token is empty!")
 		return errors.New("Bot token is empty!")
 	}
 	if !tel.botRunning {
-		tel.lastStatusMessage = "Bot is not running!"
+		tel.setStatus("Bot is not running!")
 		return errors.New("Bot is not running!")
 	}
-	if tel.chatid == 0 {
-		tel.lastStatusMessage = "Chat ID empty!"
+	chatid, _ := strconv.ParseInt(conf.Map["chatid"], 10, 64)
+	if chatid == 0 {
+		tel.setStatus("Chat ID empty!")
 		return errors.New("Chat ID empty!")
 	}
 
 	params := &bot.SendPhotoParams{
-		ChatID:  tel.chatid,
+		ChatID:  chatid,
 		Photo:   &models.InputFileUpload{Filename: "snapshot.jpeg", Data: bytes.NewReader(n.JpegData)},
 		Caption: n.Caption,
 	}
 
 	_, err := tel.bot.SendPhoto(tel.ctx, params)
 	if err != nil {
-		tel.lastStatusMessage = err.Error()
+		tel.setStatus(err.Error())
 		return err
 	}
-	tel.lastStatusMessage = "Online"
+	tel.setStatus("Online")
 	return nil
 }
 
 func (tel *FNDTelegramNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
 	tel.botStop()
-	return tel.config, nil
+	return tel.getConfiguration(), nil
 }
 
 func (tel *FNDTelegramNotificationSink) botStart() error {
-	if tel.config.Map["enabled"] != "true" {
+	conf := tel.getConfiguration()
+	if conf.Map["enabled"] != "true" {
 		return errors.New("Bot is disabeled!")
 	}
-	if tel.config.Map["token"] == "" {
+	if conf.Map["token"] == "" {
 		return errors.New("Bot Token is empty!")
 	}
 	if tel.botRunning {
@@ -223,7 +231,7 @@ func (tel *FNDTelegramNotificationSink) botStart() error {
 	}
 
 	var err error
-	tel.bot, err = bot.New(tel.config.Map["token"], opts...)
+	tel.bot, err = bot.New(conf.Map["token"], opts...)
 	if err != nil {
 		return err
 	}
@@ -256,14 +264,11 @@ func (tel *FNDTelegramNotificationSink) botHandler(ctx context.Context, b *bot.B
 	}
 }
 
-func (tel *FNDTelegramNotificationSink) getConfiguration() FNDNotificationConfigurationMap {
-	return tel.config
-}
-
 func (tel *FNDTelegramNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := tel.statusMessage()
 	return FNDNotificationSinkStatus{
 		Name:    tel.getName(),
 		Good:    tel.botRunning,
-		Message: tel.lastStatusMessage,
+		Message: msg,
 	}
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_CAPTION_TEMPLATE = `{{t "camera"}}: {{.Camera}} {{t "object"}}: {{label .Label}} {{date .Time}}`
+	DEFAULT_TITLE_TEMPLATE   = "Frigate: {{.Camera}}"
+)
+
+// Everything caption and title templates have access to
+type FNDNotificationEvent struct {
+	ID          string
+	Camera      string
+	Label       string
+	SubLabel    string
+	Score       float32
+	TopScore    float32
+	Zones       []string
+	Time        time.Time
+	FrigateURL  string
+	SnapshotURL string
+	ClipURL     string
+}
+
+// Caption and title template input of a sink settings page
+type SinkTemplatePayload struct {
+	CaptionTemplate string
+	TitleTemplate   string
+	Language        string
+	Languages       []string
+	Preview         string
+	// name of an additional sink instance, posted with the form, see FNDWebServer.serveHTTP
+	Instance       string
+	TranslatedText []string
+}
+
+func newFNDNotificationEvent(id string, frigateURL string) FNDNotificationEvent {
+	return FNDNotificationEvent{
+		ID:          id,
+		Time:        time.Now(),
+		FrigateURL:  frigateURL,
+		SnapshotURL: frigateURL + "/api/events/" + id + "/snapshot.jpg",
+		ClipURL:     frigateURL + "/api/events/" + id + "/clip.mp4",
+	}
+}
+
+// Example event for previews
+func sampleFNDNotificationEvent(fConf *FNDFrigateConfiguration) FNDNotificationEvent {
+	return sampleFNDNotificationEventWithID(fConf, "1700000000.000000-test")
+}
+
+// Example event for test notifications, the links are built from id
+func sampleFNDNotificationEventWithID(fConf *FNDFrigateConfiguration, id string) FNDNotificationEvent {
+	ev := newFNDNotificationEvent(id, fConf.frigateURL())
+	ev.Camera = "Test"
+	ev.Label = "person"
+	ev.SubLabel = "Bob"
+	ev.Score = 0.87
+	ev.TopScore = 0.91
+	ev.Zones = []string{"driveway"}
+	return ev
+}
+
+// t and label translate with tr, so every sink can have its own language
+func notificationTemplateFuncs(tr Translator) template.FuncMap {
+	return template.FuncMap{
+		"date": func(t time.Time) string {
+			return t.Format("15:04:05 02.01.2006")
+		},
+		"percent": func(score float32) string {
+			return fmt.Sprintf("%.0f%%", score*100)
+		},
+		"join":  strings.Join,
+		"t":     tr.lookupToken,
+		"label": tr.label,
+	}
+}
+
+func parseNotificationTemplate(text string, tr Translator) (*template.Template, error) {
+	return template.New("notification").Funcs(notificationTemplateFuncs(tr)).Parse(text)
+}
+
+// Checks a template by parsing it and rendering the sample event
+func validateNotificationTemplate(text string) error {
+	t, err := parseNotificationTemplate(text, Translator{})
+	if err != nil {
+		return err
+	}
+	return t.Execute(&bytes.Buffer{}, sampleFNDNotificationEvent(&FNDFrigateConfiguration{}))
+}
+
+func renderNotificationTemplate(text string, ev FNDNotificationEvent, tr Translator) (string, error) {
+	t, err := parseNotificationTemplate(text, tr)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, ev)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Creates the notification for ev with the caption and title templates of its camera,
+// falling back to the global templates and then to the defaults. Caption and title
+// are rendered per sink by forSink.
+func (fConf *FNDFrigateConfiguration) newNotification(ev FNDNotificationEvent) FNDNotification {
+	n := FNDNotification{
+		ID:              ev.ID,
+		Event:           ev,
+		Date:            ev.Time.Format("15:04:05 02.01.2006"),
+		CaptionTemplate: DEFAULT_CAPTION_TEMPLATE,
+		TitleTemplate:   DEFAULT_TITLE_TEMPLATE,
+	}
+
+	fConf.m.Lock()
+	if fConf.CaptionTemplate != "" {
+		n.CaptionTemplate = fConf.CaptionTemplate
+	}
+	if fConf.TitleTemplate != "" {
+		n.TitleTemplate = fConf.TitleTemplate
+	}
+	cam := fConf.Cameras[ev.Camera]
+	if cam.CaptionTemplate != "" {
+		n.CaptionTemplate = cam.CaptionTemplate
+	}
+	if cam.TitleTemplate != "" {
+		n.TitleTemplate = cam.TitleTemplate
+	}
+	fConf.m.Unlock()
+
+	return n
+}
+
+// Renders the caption and title of n from its templates
+func (n *FNDNotification) render(tr Translator) error {
+	caption, err := renderNotificationTemplate(n.CaptionTemplate, n.Event, tr)
+	if err != nil {
+		return err
+	}
+	title, err := renderNotificationTemplate(n.TitleTemplate, n.Event, tr)
+	if err != nil {
+		return err
+	}
+	n.Caption = caption
+	n.Title = title
+	return nil
+}
+
+// Returns n with caption and title rendered for a sink, from the templates
+// configured for the sink if there are any, in the language of tr.
+// If a template fails the defaults are used.
+func (n FNDNotification) forSink(conf FNDNotificationConfigurationMap, tr Translator) FNDNotification {
+	if caption := conf.Map["caption_template"]; caption != "" {
+		n.CaptionTemplate = caption
+	}
+	if title := conf.Map["title_template"]; title != "" {
+		n.TitleTemplate = title
+	}
+
+	err := n.render(tr)
+	if err != nil {
+		LogError("Rendering notification template failed, using default: %v", err)
+		n.CaptionTemplate = DEFAULT_CAPTION_TEMPLATE
+		n.TitleTemplate = DEFAULT_TITLE_TEMPLATE
+		_ = n.render(tr)
+	}
+	return n
+}
+
+// Notifications are sent in the language of the sink, or in the configured language
+func notificationTranslator(trans *Translation, fConf *FNDFrigateConfiguration, conf FNDNotificationConfigurationMap) Translator {
+	lang := conf.Map["language"]
+	if lang == "" {
+		lang = fConf.Language
+	}
+	return trans.translator(lang)
+}
+
+// For templates a sink renders itself, in the language of the sink.
+// Nothing is translated before the sink knows the web server.
+func sinkTranslator(webServer *FNDWebServer, conf FNDNotificationConfigurationMap) Translator {
+	if webServer == nil {
+		return Translator{}
+	}
+	return notificationTranslator(webServer.translation, webServer.frigateConf, conf)
+}
+
+// Reads caption_template, title_template and language of a sink settings form into conf.
+// Invalid input is rejected and leaves conf untouched.
+func applyTemplateForm(c *gin.Context, conf FNDNotificationConfigurationMap, trans *Translation) error {
+	caption := strings.TrimSpace(c.PostForm("caption_template"))
+	title := strings.TrimSpace(c.PostForm("title_template"))
+	lang := c.PostForm("language")
+
+	if lang != "" && !slices.Contains(trans.getLanguages(), lang) {
+		return errors.New("Language not supported")
+	}
+	if caption != "" {
+		if err := validateNotificationTemplate(caption); err != nil {
+			return errors.New("Caption: " + err.Error())
+		}
+	}
+	if title != "" {
+		if err := validateNotificationTemplate(title); err != nil {
+			return errors.New("Title: " + err.Error())
+		}
+	}
+
+	conf.Map["caption_template"] = caption
+	conf.Map["title_template"] = title
+	conf.Map["language"] = lang
+	return nil
+}
+
+// Template input and, after a post, a preview of the caption a sink would send
+func generateSinkTemplatePayload(webServer *FNDWebServer, tr Translator, conf FNDNotificationConfigurationMap, postReq bool) SinkTemplatePayload {
+	pay := SinkTemplatePayload{
+		CaptionTemplate: conf.Map["caption_template"],
+		TitleTemplate:   conf.Map["title_template"],
+		Language:        conf.Map["language"],
+		Languages:       webServer.translation.getLanguages(),
+		Instance:        webServer.instance,
+		TranslatedText: []string{
+			tr.lookupToken("caption_template"),
+			tr.lookupToken("title_template"),
+			tr.lookupToken("template_default"),
+			tr.lookupToken("preview"),
+			tr.lookupToken("notification_language"),
+			tr.lookupToken("default"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	n := webServer.frigateConf.newNotification(sampleFNDNotificationEvent(webServer.frigateConf))
+	n = n.forSink(conf, notificationTranslator(webServer.translation, webServer.frigateConf, conf))
+	pay.Preview = n.Title + ": " + n.Caption
+	return pay
+}
+
+type CaptionCameraPayload struct {
+	Name            string
+	CaptionTemplate string
+	TitleTemplate   string
+	Preview         string
+}
+
+type CaptionsPayload struct {
+	ShowStatus      bool
+	Color           string
+	StatusMessage   string
+	CaptionTemplate string
+	TitleTemplate   string
+	Preview         string
+	Cameras         []CaptionCameraPayload
+	Doc             htmltemplate.HTML
+	TranslatedText  []string
+}
+
+func previewNotificationTemplates(web *FNDWebServer, camera string, caption string, title string) string {
+	ev := sampleFNDNotificationEvent(web.frigateConf)
+	if camera != "" {
+		ev.Camera = camera
+	}
+	tr := web.translation.translator(web.frigateConf.Language)
+
+	renderedCaption, err := renderNotificationTemplate(caption, ev, tr)
+	if err != nil {
+		return err.Error()
+	}
+	renderedTitle, err := renderNotificationTemplate(title, ev, tr)
+	if err != nil {
+		return err.Error()
+	}
+	return renderedTitle + ": " + renderedCaption
+}
+
+// Builds the captions page from the given templates. Empty camera templates fall back
+// to the global ones, empty global templates to the defaults.
+func generateCaptionsPayload(web *FNDWebServer, tr Translator, caption string, title string, cameras []CaptionCameraPayload, preview bool) CaptionsPayload {
+	pay := CaptionsPayload{
+		CaptionTemplate: caption,
+		TitleTemplate:   title,
+		Cameras:         cameras,
+		TranslatedText: []string{
+			tr.lookupToken("captions"),
+			tr.lookupToken("caption_template"),
+			tr.lookupToken("title_template"),
+			tr.lookupToken("template_default"),
+			tr.lookupToken("preview"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("all_cameras"),
+		},
+		// translations are trusted, the documentation contains links
+		Doc: htmltemplate.HTML(tr.lookupToken("template_doc")),
+	}
+
+	if !preview {
+		return pay
+	}
+
+	if caption == "" {
+		caption = DEFAULT_CAPTION_TEMPLATE
+	}
+	if title == "" {
+		title = DEFAULT_TITLE_TEMPLATE
+	}
+	pay.Preview = previewNotificationTemplates(web, "", caption, title)
+
+	for i, cam := range pay.Cameras {
+		camCaption := caption
+		if cam.CaptionTemplate != "" {
+			camCaption = cam.CaptionTemplate
+		}
+		camTitle := title
+		if cam.TitleTemplate != "" {
+			camTitle = cam.TitleTemplate
+		}
+		pay.Cameras[i].Preview = previewNotificationTemplates(web, cam.Name, camCaption, camTitle)
+	}
+	return pay
+}
+
+func registerCaptionRoutes(web *FNDWebServer) {
+	web.r.GET("/htmx/captions.html", func(c *gin.Context) {
+		conf := web.frigateConf
+
+		conf.m.Lock()
+		var cameras []CaptionCameraPayload
+		for _, cam := range conf.Cameras {
+			cameras = append(cameras, CaptionCameraPayload{
+				Name:            cam.Name,
+				CaptionTemplate: cam.CaptionTemplate,
+				TitleTemplate:   cam.TitleTemplate,
+			})
+		}
+		caption := conf.CaptionTemplate
+		title := conf.TitleTemplate
+		conf.m.Unlock()
+		slices.SortFunc(cameras, func(a, b CaptionCameraPayload) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		t := htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/captions.html"))
+		t.Execute(c.Writer, generateCaptionsPayload(web, web.translatorFor(c), caption, title, cameras, false))
+	})
+
+	web.r.POST("/htmx/captions.html", func(c *gin.Context) {
+		conf := web.frigateConf
+		c.MultipartForm()
+
+		caption := strings.TrimSpace(c.PostForm("caption_template"))
+		title := strings.TrimSpace(c.PostForm("title_template"))
+		var cameras []CaptionCameraPayload
+		for _, name := range c.PostFormArray("camera") {
+			cameras = append(cameras, CaptionCameraPayload{
+				Name:            name,
+				CaptionTemplate: strings.TrimSpace(c.PostForm("caption_template_" + name)),
+				TitleTemplate:   strings.TrimSpace(c.PostForm("title_template_" + name)),
+			})
+		}
+
+		tr := web.translatorFor(c)
+		pay := generateCaptionsPayload(web, tr, caption, title, cameras, true)
+		pay.ShowStatus = true
+
+		// everything is validated before anything is applied
+		var err error
+		for _, text := range []string{caption, title} {
+			if text != "" && err == nil {
+				err = validateNotificationTemplate(text)
+			}
+		}
+		for _, cam := range cameras {
+			for _, text := range []string{cam.CaptionTemplate, cam.TitleTemplate} {
+				if text != "" && err == nil {
+					err = validateNotificationTemplate(text)
+				}
+			}
+		}
+
+		t := htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/captions.html"))
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+			t.Execute(c.Writer, pay)
+			return
+		}
+
+		if c.PostForm("action") == "apply" {
+			conf.m.Lock()
+			conf.CaptionTemplate = caption
+			conf.TitleTemplate = title
+			conf.m.Unlock()
+			for _, cam := range cameras {
+				conf.setCameraTemplates(cam.Name, cam.CaptionTemplate, cam.TitleTemplate)
+			}
+			pay.Color = "is-primary"
+			pay.StatusMessage = "OK"
+		} else {
+			pay.Color = "is-info"
+			pay.StatusMessage = tr.lookupToken("preview")
+		}
+
+		t.Execute(c.Writer, pay)
+	})
+}
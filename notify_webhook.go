@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WEBHOOK_IMAGE_NONE      = "none"
+	WEBHOOK_IMAGE_BASE64    = "base64"
+	WEBHOOK_IMAGE_MULTIPART = "multipart"
+
+	WEBHOOK_SIGNATURE_HEADER = "X-FND-Signature"
+	WEBHOOK_DEFAULT_RETRIES  = 3
+	WEBHOOK_TIMEOUT          = 10 * time.Second
+	// retries must not hold up the queue of the sink for long, at most 1s + 2s + 2s
+	// are spent waiting, later retries are up to the outbox
+	WEBHOOK_MAX_RETRIES     = 3
+	WEBHOOK_MAX_RETRY_DELAY = 2 * time.Second
+	// all attempts of one delivery, well within SINK_DELIVERY_TIMEOUT, so a late
+	// success never races the retry from the outbox
+	WEBHOOK_DELIVERY_TIMEOUT = 30 * time.Second
+)
+
+const DEFAULT_WEBHOOK_BODY_TEMPLATE = `{
+  "id": {{json .ID}},
+  "camera": {{json .Camera}},
+  "label": {{json .Label}},
+  "sub_label": {{json .SubLabel}},
+  "score": {{json .Score}},
+  "top_score": {{json .TopScore}},
+  "zones": {{json .Zones}},
+  "time": {{json .Time}},
+  "title": {{json .Title}},
+  "caption": {{json .Caption}},
+  "snapshot_url": {{json .SnapshotURL}},
+  "clip_url": {{json .ClipURL}}{{if .Image}},
+  "image": {{json .Image}}{{end}}
+}`
+
+var webhookImageModes = []string{WEBHOOK_IMAGE_NONE, WEBHOOK_IMAGE_BASE64, WEBHOOK_IMAGE_MULTIPART}
+
+type FNDWebhookNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+}
+
+// Everything the JSON body template has access to: the fields of the caption
+// templates, the rendered caption and title and, in base64 mode, the snapshot
+type WebhookBodyData struct {
+	FNDNotificationEvent
+	Title   string
+	Caption string
+	Image   string
+}
+
+type WebhookTemplatePayload struct {
+	Active         bool
+	URL            string
+	Image          string
+	ImageModes     []string
+	Headers        string
+	HasSecret      bool
+	Retries        string
+	BodyTemplate   string
+	DefaultBody    string
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (webhook *FNDWebhookNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["image"] = WEBHOOK_IMAGE_NONE
+	conf.Map["retries"] = strconv.Itoa(WEBHOOK_DEFAULT_RETRIES)
+	webhook.setConfiguration(conf)
+}
+
+func (webhook *FNDWebhookNotificationSink) getName() string {
+	return "Webhook"
+}
+
+func (webhook *FNDWebhookNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		webhook.setConfiguration(conf)
+	} else {
+		webhook.createDefaultConfig()
+	}
+	webhook.client = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	webhook.setStatus("init")
+	return nil
+}
+
+func (webhook *FNDWebhookNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	webhook.webServer = webServer
+
+	webhook.webServer.r.GET("/htmx/webhook.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/webhook.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, webhook.generatePayload(webhook.webServer.translatorFor(c), false))
+	})
+
+	webhook.webServer.r.POST("/htmx/webhook.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		err := webhook.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+			if err := webhook.applyForm(c, conf); err != nil {
+				return err
+			}
+			return applyTemplateForm(c, conf, webhook.webServer.translation)
+		})
+
+		pay := webhook.generatePayload(webhook.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/webhook.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the webhook settings form into the configuration.
+// Everything is validated first, invalid input leaves the configuration untouched.
+func (webhook *FNDWebhookNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	target := strings.TrimSpace(c.PostForm("url"))
+	image := c.PostForm("image")
+	headers := strings.TrimSpace(c.PostForm("headers"))
+	secret := c.PostForm("secret")
+	retries := strings.TrimSpace(c.PostForm("retries"))
+	body := strings.TrimSpace(c.PostForm("body_template"))
+
+	if target != "" {
+		if err := validateSinkURL(target); err != nil {
+			return err
+		}
+	}
+	if !slices.Contains(webhookImageModes, image) {
+		return errors.New("Unknown snapshot mode: " + image)
+	}
+	if _, err := parseWebhookHeaders(headers); err != nil {
+		return err
+	}
+	if retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 || n > WEBHOOK_MAX_RETRIES {
+			return errors.New("Retries must be between 0 and " + strconv.Itoa(WEBHOOK_MAX_RETRIES))
+		}
+	}
+	if body != "" {
+		if err := validateWebhookBody(body); err != nil {
+			return errors.New("Body: " + err.Error())
+		}
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if target != "" {
+		conf.Map["url"] = target
+	}
+	conf.Map["image"] = image
+	conf.Map["headers"] = headers
+	if secret != "" {
+		conf.Map["secret"] = secret
+	}
+	if c.PostForm("clear_secret") != "" {
+		delete(conf.Map, "secret")
+	}
+	if retries != "" {
+		conf.Map["retries"] = retries
+	}
+	conf.Map["body_template"] = body
+	return nil
+}
+
+func (webhook *FNDWebhookNotificationSink) generatePayload(tr Translator, postReq bool) WebhookTemplatePayload {
+	conf := webhook.getConfiguration()
+	image := conf.Map["image"]
+	if image == "" {
+		image = WEBHOOK_IMAGE_NONE
+	}
+
+	pay := WebhookTemplatePayload{
+		Active:       conf.enabled(),
+		URL:          conf.Map["url"],
+		Image:        image,
+		ImageModes:   webhookImageModes,
+		Headers:      conf.Map["headers"],
+		HasSecret:    conf.Map["secret"] != "",
+		Retries:      strconv.Itoa(webhook.retries()),
+		BodyTemplate: conf.Map["body_template"],
+		DefaultBody:  DEFAULT_WEBHOOK_BODY_TEMPLATE,
+		Templates:    generateSinkTemplatePayload(webhook.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("webhook_doc"),
+			tr.lookupToken("image"),
+			tr.lookupToken("image_none"),
+			tr.lookupToken("image_base64"),
+			tr.lookupToken("image_multipart"),
+			tr.lookupToken("headers"),
+			tr.lookupToken("secret"),
+			tr.lookupToken("retries"),
+			tr.lookupToken("body_template"),
+			tr.lookupToken("template_default"),
+			tr.lookupToken("default"),
+			tr.lookupToken("secret_clear"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+func (webhook *FNDWebhookNotificationSink) retries() int {
+	conf := webhook.getConfiguration()
+	n, err := strconv.Atoi(conf.Map["retries"])
+	if err != nil || n < 0 {
+		return WEBHOOK_DEFAULT_RETRIES
+	}
+	return min(n, WEBHOOK_MAX_RETRIES)
+}
+
+func webhookTemplateFuncs(tr Translator) template.FuncMap {
+	funcs := notificationTemplateFuncs(tr)
+	funcs["json"] = func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+	return funcs
+}
+
+func renderWebhookBody(text string, data WebhookBodyData, tr Translator) ([]byte, error) {
+	t, err := template.New("webhook").Funcs(webhookTemplateFuncs(tr)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template does not render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// Checks a body template by rendering the sample event, with an image so {{if .Image}} is covered
+func validateWebhookBody(text string) error {
+	data := WebhookBodyData{
+		FNDNotificationEvent: sampleFNDNotificationEvent(&FNDFrigateConfiguration{}),
+		Title:                "Title",
+		Caption:              "Caption",
+		Image:                "aW1hZ2U=",
+	}
+	_, err := renderWebhookBody(text, data, Translator{})
+	return err
+}
+
+// Parses one "Name: value" header per line, empty lines are ignored
+func parseWebhookHeaders(text string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, errors.New("Invalid header line: " + line)
+		}
+		headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+func (webhook *FNDWebhookNotificationSink) sendNotification(n FNDNotification) error {
+	conf := webhook.getConfiguration()
+	if !conf.enabled() {
+		webhook.setStatus("disabled")
+		return nil
+	}
+	target := conf.Map["url"]
+	if target == "" {
+		webhook.setStatus("URL is empty!")
+		return errors.New("URL is empty!")
+	}
+
+	data := WebhookBodyData{
+		FNDNotificationEvent: n.Event,
+		Title:                n.Title,
+		Caption:              n.Caption,
+	}
+	mode := conf.Map["image"]
+	if mode == WEBHOOK_IMAGE_BASE64 {
+		data.Image = base64.StdEncoding.EncodeToString(n.JpegData)
+	}
+
+	bodyTemplate := conf.Map["body_template"]
+	if bodyTemplate == "" {
+		bodyTemplate = DEFAULT_WEBHOOK_BODY_TEMPLATE
+	}
+	body, err := renderWebhookBody(bodyTemplate, data, sinkTranslator(webhook.webServer, conf))
+	if err != nil {
+		webhook.setStatus("Body template failed")
+		return errors.New("Webhook body template: " + err.Error())
+	}
+
+	contentType := "application/json"
+	if mode == WEBHOOK_IMAGE_MULTIPART {
+		body, contentType, err = webhookMultipartBody(body, n.JpegData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = webhook.post(target, body, contentType)
+	if err != nil {
+		webhook.setStatus(err.Error())
+		return err
+	}
+	webhook.setStatus("Online")
+	return nil
+}
+
+// The JSON body as "payload" part, the snapshot as "snapshot" file
+func webhookMultipartBody(payload []byte, jpeg []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="payload"`)
+	header.Set("Content-Type", "application/json")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = part.Write(payload); err != nil {
+		return nil, "", err
+	}
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="snapshot"; filename="snapshot.jpg"`)
+	header.Set("Content-Type", "image/jpeg")
+	part, err = writer.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = part.Write(jpeg); err != nil {
+		return nil, "", err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+// Wait before retry number attempt: 1s, then 2s
+func webhookRetryDelay(attempt int) time.Duration {
+	return min(time.Duration(1<<(attempt-1))*time.Second, WEBHOOK_MAX_RETRY_DELAY)
+}
+
+// Posts body, retrying network errors, 429 and 5xx (see webhookRetryDelay).
+// All attempts end after WEBHOOK_DELIVERY_TIMEOUT, later retries are up to the outbox.
+func (webhook *FNDWebhookNotificationSink) post(target string, body []byte, contentType string) error {
+	retries := webhook.retries()
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_DELIVERY_TIMEOUT)
+	defer cancel()
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(webhookRetryDelay(attempt)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		var retry bool
+		retry, err = webhook.postOnce(ctx, target, body, contentType)
+		if err == nil || !retry {
+			return err
+		}
+		LogWarn("Webhook attempt %d/%d failed: %v", attempt+1, retries+1, err)
+	}
+	return err
+}
+
+// Returns whether a failed request is worth retrying
+func (webhook *FNDWebhookNotificationSink) postOnce(ctx context.Context, target string, body []byte, contentType string) (bool, error) {
+	conf := webhook.getConfiguration()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	// validated when saved, but the configuration file may have been edited by hand
+	headers, err := parseWebhookHeaders(conf.Map["headers"])
+	if err != nil {
+		return false, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if secret := conf.Map["secret"]; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhook.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New("Webhook statuscode: " + strconv.Itoa(resp.StatusCode))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+func (webhook *FNDWebhookNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return webhook.getConfiguration(), nil
+}
+
+func (webhook *FNDWebhookNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := webhook.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    webhook.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
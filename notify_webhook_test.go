@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 3, want: 2 * time.Second},
+		{attempt: 10, want: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			if got := webhookRetryDelay(tt.attempt); got != tt.want {
+				t.Errorf("webhookRetryDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+
+	// the waits of all retries leave time for the requests themselves
+	var waits time.Duration
+	for attempt := 1; attempt <= WEBHOOK_MAX_RETRIES; attempt++ {
+		waits += webhookRetryDelay(attempt)
+	}
+	if waits >= WEBHOOK_DELIVERY_TIMEOUT/2 {
+		t.Errorf("retries wait %s of WEBHOOK_DELIVERY_TIMEOUT %s", waits, WEBHOOK_DELIVERY_TIMEOUT)
+	}
+	if WEBHOOK_DELIVERY_TIMEOUT >= SINK_DELIVERY_TIMEOUT {
+		t.Errorf("WEBHOOK_DELIVERY_TIMEOUT is not below SINK_DELIVERY_TIMEOUT")
+	}
+}
+
+func TestWebhookPostRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		requests int32
+	}{
+		{name: "success", statuses: []int{http.StatusNoContent}, requests: 1},
+		{name: "server error retried", statuses: []int{http.StatusBadGateway, http.StatusOK}, requests: 2},
+		{name: "too many requests retried", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, requests: 2},
+		{name: "client error not retried", statuses: []int{http.StatusBadRequest, http.StatusOK}, wantErr: true, requests: 1},
+		{name: "retries used up", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}, wantErr: true, requests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				w.WriteHeader(tt.statuses[min(int(n), len(tt.statuses))-1])
+			}))
+			defer server.Close()
+
+			conf := NEWDefaultFNDNotificationConfigurationMap()
+			conf.Map["retries"] = "1"
+			webhook := &FNDWebhookNotificationSink{}
+			webhook.setup(conf, true)
+
+			err := webhook.post(server.URL, []byte("{}"), "application/json")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("post failed with %v, want an error: %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("post sent %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WEBPUSH_TIMEOUT = 15 * time.Second
+	// how long push services keep a notification for an offline browser
+	WEBPUSH_TTL             = time.Hour
+	WEBPUSH_JWT_LIFETIME    = 12 * time.Hour
+	WEBPUSH_DEFAULT_SUBJECT = "mailto:fnd@example.com"
+
+	// one aes128gcm record, the payload has to fit into it together with padding delimiter and tag
+	WEBPUSH_RECORD_SIZE = 4096
+	WEBPUSH_MAX_PAYLOAD = WEBPUSH_RECORD_SIZE - 17
+	WEBPUSH_MAX_NAME    = 100
+)
+
+type FNDWebPushNotificationSink struct {
+	FNDSinkState
+	webServer *FNDWebServer
+	client    *http.Client
+	vapidKey  *ecdsa.PrivateKey
+
+	// guards the subscriptions in config, they are changed by browsers and by sendNotification
+	m sync.Mutex
+}
+
+// PushSubscription of the browser as returned by toJSON(), plus a name to tell the browsers apart
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// Shown by the service worker (static/sw.js)
+type WebPushMessage struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Image     string `json:"image,omitempty"`
+	Tag       string `json:"tag"`
+	URL       string `json:"url,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type WebPushTemplatePayload struct {
+	Active         bool
+	Subject        string
+	Subscriptions  []WebPushSubscription
+	ShowStatus     bool
+	Color          string
+	StatusMessage  string
+	Templates      SinkTemplatePayload
+	TranslatedText []string
+}
+
+func (push *FNDWebPushNotificationSink) createDefaultConfig() {
+	conf := NEWDefaultFNDNotificationConfigurationMap()
+	conf.Map["enabled"] = "false"
+	conf.Map["subject"] = WEBPUSH_DEFAULT_SUBJECT
+	push.setConfiguration(conf)
+}
+
+func (push *FNDWebPushNotificationSink) getName() string {
+	return "WebPush"
+}
+
+// Loads the VAPID key or generates one on the first start.
+// A new key invalidates all subscriptions, so it is kept in the configuration.
+func (push *FNDWebPushNotificationSink) setup(conf FNDNotificationConfigurationMap, avail bool) error {
+	if avail {
+		push.setConfiguration(conf)
+	} else {
+		push.createDefaultConfig()
+	}
+	push.client = &http.Client{Timeout: WEBPUSH_TIMEOUT}
+	push.setStatus("init")
+
+	if der, err := base64.StdEncoding.DecodeString(push.getConfiguration().Map["vapid_private_key"]); err == nil && len(der) > 0 {
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return errors.New("VAPID key is not an ECDSA key")
+		}
+		push.vapidKey = ecKey
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	push.vapidKey = key
+	push.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+		conf.Map["vapid_private_key"] = base64.StdEncoding.EncodeToString(der)
+		delete(conf.Map, "subscriptions")
+		return nil
+	})
+	LogInfo("Generated new VAPID key for Web Push")
+	return nil
+}
+
+// Application server key for pushManager.subscribe, the uncompressed public key in base64url
+func (push *FNDWebPushNotificationSink) publicKey() string {
+	pub, err := push.vapidKey.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+func (push *FNDWebPushNotificationSink) registerWebServer(webServer *FNDWebServer) {
+	push.webServer = webServer
+
+	// the service worker controls the pages below its path, so it lives at the root
+	push.webServer.r.GET("/sw.js", func(c *gin.Context) {
+		c.Header("Service-Worker-Allowed", "/")
+		c.FileFromFS("static/sw.js", http.FS(staticFS))
+	})
+	push.webServer.r.GET("/static/webpush.js", func(c *gin.Context) {
+		c.FileFromFS("static/webpush.js", http.FS(staticFS))
+	})
+
+	push.webServer.r.GET("/api/webpush/key", func(c *gin.Context) {
+		c.String(http.StatusOK, push.publicKey())
+	})
+
+	push.webServer.r.POST("/api/webpush/subscribe", func(c *gin.Context) {
+		var sub WebPushSubscription
+		if err := c.ShouldBindJSON(&sub); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := push.subscribe(sub); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	push.webServer.r.GET("/htmx/webpush.html", func(c *gin.Context) {
+		t := template.Must(template.ParseFS(templateFS, "templates/webpush.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, push.generatePayload(push.webServer.translatorFor(c), false))
+	})
+
+	push.webServer.r.POST("/htmx/webpush.html", func(c *gin.Context) {
+		c.MultipartForm()
+
+		// the remove button of a browser only removes its subscription
+		var err error
+		if endpoint := c.PostForm("remove"); endpoint != "" {
+			push.unsubscribe(endpoint)
+		} else {
+			err = push.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+				if err := push.applyForm(c, conf); err != nil {
+					return err
+				}
+				return applyTemplateForm(c, conf, push.webServer.translation)
+			})
+		}
+
+		pay := push.generatePayload(push.webServer.translatorFor(c), true)
+		if err != nil {
+			pay.Color = "is-danger"
+			pay.StatusMessage = err.Error()
+		}
+
+		t := template.Must(template.ParseFS(templateFS, "templates/webpush.html", "templates/caption_fields.html"))
+		t.Execute(c.Writer, pay)
+	})
+}
+
+// Reads the Web Push settings form into the configuration
+func (push *FNDWebPushNotificationSink) applyForm(c *gin.Context, conf FNDNotificationConfigurationMap) error {
+	subject := strings.TrimSpace(c.PostForm("subject"))
+	if subject != "" && !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return errors.New("Contact must be a mailto: or https:// URL")
+	}
+
+	conf.Map["enabled"] = strconv.FormatBool(c.PostForm("aktiv") != "")
+	if subject != "" {
+		conf.Map["subject"] = subject
+	}
+	return nil
+}
+
+func (push *FNDWebPushNotificationSink) generatePayload(tr Translator, postReq bool) WebPushTemplatePayload {
+	conf := push.getConfiguration()
+	push.m.Lock()
+	subs := push.subscriptions()
+	push.m.Unlock()
+
+	pay := WebPushTemplatePayload{
+		Active:        conf.enabled(),
+		Subject:       conf.Map["subject"],
+		Subscriptions: subs,
+		Templates:     generateSinkTemplatePayload(push.webServer, tr, conf, postReq),
+		TranslatedText: []string{
+			tr.lookupToken("active"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("webpush_doc"),
+			tr.lookupToken("vapid_subject"),
+			tr.lookupToken("subscriptions"),
+			tr.lookupToken("remove"),
+			tr.lookupToken("subscribe_browser"),
+			tr.lookupToken("browser_name"),
+			tr.lookupToken("no_subscriptions"),
+		},
+	}
+
+	if !postReq {
+		return pay
+	}
+
+	pay.ShowStatus = true
+	pay.Color = "is-primary"
+	pay.StatusMessage = "OK"
+
+	return pay
+}
+
+// Must be called with push.m locked
+func (push *FNDWebPushNotificationSink) subscriptions() []WebPushSubscription {
+	conf := push.getConfiguration()
+	var subs []WebPushSubscription
+	if s := conf.Map["subscriptions"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &subs); err != nil {
+			LogWarn("Web Push subscriptions ignored: %v", err)
+		}
+	}
+	return subs
+}
+
+// Must be called with push.m locked
+func (push *FNDWebPushNotificationSink) setSubscriptions(subs []WebPushSubscription) {
+	data, err := json.Marshal(subs)
+	if err != nil {
+		LogError("Web Push subscriptions not saved: %v", err)
+		return
+	}
+	push.updateConfiguration(func(conf FNDNotificationConfigurationMap) error {
+		conf.Map["subscriptions"] = string(data)
+		return nil
+	})
+}
+
+// Adds sub or replaces the subscription with the same endpoint
+func (push *FNDWebPushNotificationSink) subscribe(sub WebPushSubscription) error {
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("Endpoint must be an https URL")
+	}
+	if p256dh, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "=")); err != nil || len(p256dh) != 65 {
+		return errors.New("p256dh is not a P-256 public key")
+	}
+	if auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "=")); err != nil || len(auth) != 16 {
+		return errors.New("auth is not a 16 byte secret")
+	}
+	sub.Name = truncateRunes(strings.TrimSpace(sub.Name), WEBPUSH_MAX_NAME)
+	if sub.Name == "" {
+		sub.Name = "Browser"
+	}
+	sub.Created = time.Now()
+
+	push.m.Lock()
+	defer push.m.Unlock()
+
+	subs := push.subscriptions()
+	for i := range subs {
+		if subs[i].Endpoint == sub.Endpoint {
+			subs[i] = sub
+			push.setSubscriptions(subs)
+			return nil
+		}
+	}
+	push.setSubscriptions(append(subs, sub))
+	LogInfo("Web Push subscription added: %s", sub.Name)
+	return nil
+}
+
+func (push *FNDWebPushNotificationSink) unsubscribe(endpoint string) {
+	push.m.Lock()
+	defer push.m.Unlock()
+
+	subs := push.subscriptions()
+	for i := range subs {
+		if subs[i].Endpoint == endpoint {
+			push.setSubscriptions(append(subs[:i], subs[i+1:]...))
+			return
+		}
+	}
+}
+
+// RFC 5869 with SHA-256, length is at most 32
+func hkdf(salt []byte, ikm []byte, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// Encrypts payload for sub with aes128gcm as described in RFC 8291
+func encryptWebPush(sub WebPushSubscription, payload []byte) ([]byte, error) {
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPushWith(sub, payload, asPrivate, salt)
+}
+
+// Like encryptWebPush with the key of this message and the salt given, like in the test vector of RFC 8291
+func encryptWebPushWith(sub WebPushSubscription, payload []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	asPublic := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// header: salt, record size, key id (the public key of this message)
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(WEBPUSH_RECORD_SIZE))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	// 0x02 marks the last and only record
+	plaintext := append(append([]byte{}, payload...), 2)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// Authorization header of RFC 8292, a JWT signed with the VAPID key for the origin of the push service
+func (push *FNDWebPushNotificationSink) vapidAuthorization(endpoint string) (string, error) {
+	conf := push.getConfiguration()
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	subject := conf.Map["subject"]
+	if subject == "" {
+		subject = WEBPUSH_DEFAULT_SUBJECT
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(WEBPUSH_JWT_LIFETIME).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, push.vapidKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are r and s with 32 bytes each
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(sig) + ", k=" + push.publicKey(), nil
+}
+
+// Returns gone=true if the push service does not know the subscription anymore
+func (push *FNDWebPushNotificationSink) deliver(sub WebPushSubscription, payload []byte) (gone bool, err error) {
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return false, err
+	}
+	auth, err := push.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(WEBPUSH_TTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := push.client.Do(req)
+	if err != nil {
+		return false, withoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return true, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, errors.New("Push service statuscode: " + strconv.Itoa(resp.StatusCode) + " " + strings.TrimSpace(string(reply)))
+	}
+	return false, nil
+}
+
+func (push *FNDWebPushNotificationSink) sendNotification(n FNDNotification) error {
+	conf := push.getConfiguration()
+	if !conf.enabled() {
+		push.setStatus("disabled")
+		return nil
+	}
+	push.m.Lock()
+	subs := push.subscriptions()
+	push.m.Unlock()
+	if len(subs) == 0 {
+		push.setStatus("No browser subscribed!")
+		return errors.New("No browser subscribed!")
+	}
+
+	msg := WebPushMessage{
+		Title:     n.Title,
+		Body:      n.Caption,
+		Tag:       n.ID,
+		URL:       n.Event.ClipURL,
+		Timestamp: n.Event.Time.UnixMilli(),
+	}
+	// the service worker loads the snapshot from fnd, a push message is too small for it
+	if len(n.JpegData) > 0 {
+		msg.Image = "/history/snapshot/" + url.PathEscape(n.ID)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > WEBPUSH_MAX_PAYLOAD {
+		msg.Body = truncateRunes(msg.Body, max(len([]rune(msg.Body))-(len(payload)-WEBPUSH_MAX_PAYLOAD)-1, 1))
+		if payload, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+
+	// one unreachable browser must not keep the others from being notified
+	var failed, failedEndpoints []string
+	for _, sub := range subs {
+		if !n.goesTo(sub.Endpoint) {
+			continue
+		}
+		gone, err := push.deliver(sub, payload)
+		if gone {
+			LogInfo("Web Push subscription expired, removed: %s", sub.Name)
+			push.unsubscribe(sub.Endpoint)
+			continue
+		}
+		if err != nil {
+			failed = append(failed, sub.Name+": "+err.Error())
+			failedEndpoints = append(failedEndpoints, sub.Endpoint)
+		}
+	}
+
+	if len(failed) > 0 {
+		push.setStatus(strconv.Itoa(len(failed)) + "/" + strconv.Itoa(len(subs)) + " browsers failed")
+		return &FNDFailedTargetsError{Targets: failedEndpoints, Err: errors.New("Web Push: " + strings.Join(failed, "; "))}
+	}
+	push.setStatus("Online")
+	return nil
+}
+
+func (push *FNDWebPushNotificationSink) remove() (FNDNotificationConfigurationMap, error) {
+	return push.getConfiguration(), nil
+}
+
+func (push *FNDWebPushNotificationSink) getStatus() FNDNotificationSinkStatus {
+	msg := push.statusMessage()
+	return FNDNotificationSinkStatus{
+		Name:    push.getName(),
+		Good:    msg == "Online",
+		Message: msg,
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+func decodeTestBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid test data %q: %v", s, err)
+	}
+	return data
+}
+
+// Test vector of RFC 8291, section 5
+func TestEncryptWebPushRFC8291(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(decodeTestBase64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sub WebPushSubscription
+	sub.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	sub.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+	salt := decodeTestBase64(t, "DGv6ra1nlYgDCS1FRnbzlw")
+	plaintext := decodeTestBase64(t, "V2hlbiBJIGdyb3cgdXAsIEkgd2FudCB0byBiZSBhIHdhdGVybWVsb24")
+
+	body, err := encryptWebPushWith(sub, plaintext, asPrivate, salt)
+	if err != nil {
+		t.Fatalf("encryptWebPushWith failed: %v", err)
+	}
+
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Errorf("encrypted message =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// the CEK and nonce of the RFC 8291 test vector
+	ikm := decodeTestBase64(t, "S4lYMb_L0FxCeq0WhDx813KgSYqU26kOyzWUdsXYyrg")
+	salt := decodeTestBase64(t, "DGv6ra1nlYgDCS1FRnbzlw")
+
+	tests := []struct {
+		name   string
+		info   string
+		length int
+		want   string
+	}{
+		{name: "cek", info: "Content-Encoding: aes128gcm\x00", length: 16, want: "oIhVW04MRdy2XN9CiKLxTg"},
+		{name: "nonce", info: "Content-Encoding: nonce\x00", length: 12, want: "4h_95klXJ5E_qnoN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := base64.RawURLEncoding.EncodeToString(hkdf(salt, ikm, []byte(tt.info), tt.length))
+			if got != tt.want {
+				t.Errorf("hkdf = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Decrypts a message like the browser does, with the private key of the subscription
+func decryptTestWebPush(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret []byte, body []byte) []byte {
+	t.Helper()
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != WEBPUSH_RECORD_SIZE {
+		t.Errorf("record size = %d, want %d", rs, WEBPUSH_RECORD_SIZE)
+	}
+	idLen := int(body[20])
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	if err != nil {
+		t.Fatalf("key id is not a public key: %v", err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uaPublic := uaPrivate.PublicKey().Bytes()
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic.Bytes()...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	block, err := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), body[21+idLen:], nil)
+	if err != nil {
+		t.Fatalf("message cannot be decrypted: %v", err)
+	}
+	if len(record) == 0 || record[len(record)-1] != 2 {
+		t.Fatalf("record does not end with the delimiter of the last record")
+	}
+	return record[:len(record)-1]
+}
+
+func TestEncryptWebPushRoundTrip(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	var sub WebPushSubscription
+	// browsers may send padded base64
+	sub.Keys.P256dh = base64.URLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes())
+	sub.Keys.Auth = base64.URLEncoding.EncodeToString(authSecret)
+
+	payload := []byte(`{"title":"garden","body":"Person detected"}`)
+	first, err := encryptWebPush(sub, payload)
+	if err != nil {
+		t.Fatalf("encryptWebPush failed: %v", err)
+	}
+	second, err := encryptWebPush(sub, payload)
+	if err != nil {
+		t.Fatalf("encryptWebPush failed: %v", err)
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("two messages use the same key and salt")
+	}
+
+	if got := decryptTestWebPush(t, uaPrivate, authSecret, first); !bytes.Equal(got, payload) {
+		t.Errorf("decrypted %q, want %q", got, payload)
+	}
+}
+
+func TestEncryptWebPushInvalidKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		p256dh string
+		auth   string
+	}{
+		{name: "not base64", p256dh: "not base64!", auth: "BTBZMqHH6r4Tts7J_aSIgg"},
+		{name: "not a point", p256dh: "BCVxsr7N", auth: "BTBZMqHH6r4Tts7J_aSIgg"},
+		{name: "auth not base64", p256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4", auth: "#"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sub WebPushSubscription
+			sub.Keys.P256dh = tt.p256dh
+			sub.Keys.Auth = tt.auth
+			if _, err := encryptWebPush(sub, []byte("x")); err == nil {
+				t.Errorf("encryptWebPush with %s succeeded, want an error", tt.name)
+			}
+		})
+	}
+}
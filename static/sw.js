@@ -0,0 +1,17 @@
+// Service worker of fnd, shows the Web Push notifications even if no fnd tab is open
+
+self.addEventListener('push', function (event) {
+    var data = event.data ? event.data.json() : {};
+    event.waitUntil(self.registration.showNotification(data.title || 'Frigate', {
+        body: data.body,
+        image: data.image,
+        tag: data.tag,
+        timestamp: data.timestamp,
+        data: { url: data.url || '/' }
+    }));
+});
+
+self.addEventListener('notificationclick', function (event) {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});
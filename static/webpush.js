@@ -0,0 +1,59 @@
+// Subscribes this browser to the Web Push notifications of fnd
+
+function fndBase64UrlToBytes(s) {
+    var padded = (s + '==='.slice((s.length + 3) % 4)).replace(/-/g, '+').replace(/_/g, '/');
+    var raw = atob(padded);
+    var bytes = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+        bytes[i] = raw.charCodeAt(i);
+    }
+    return bytes;
+}
+
+function fndSameKey(a, b) {
+    if (!a || a.byteLength !== b.byteLength) {
+        return false;
+    }
+    var view = new Uint8Array(a);
+    return view.every(function (v, i) { return v === b[i]; });
+}
+
+async function fndWebPushSubscribe(nameInput, statusTag) {
+    var status = document.getElementById(statusTag);
+    try {
+        if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
+            throw new Error('Web Push needs HTTPS (or localhost) and a browser supporting it');
+        }
+        var registration = await navigator.serviceWorker.register('/sw.js');
+        await navigator.serviceWorker.ready;
+        if (await Notification.requestPermission() !== 'granted') {
+            throw new Error('Notifications are not allowed');
+        }
+
+        var key = fndBase64UrlToBytes(await (await fetch('/api/webpush/key')).text());
+        var subscription = await registration.pushManager.getSubscription();
+        // a subscription for an old VAPID key is rejected by the push service
+        if (subscription && !fndSameKey(subscription.options.applicationServerKey, key)) {
+            await subscription.unsubscribe();
+            subscription = null;
+        }
+        if (!subscription) {
+            subscription = await registration.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: key });
+        }
+
+        var body = subscription.toJSON();
+        body.name = document.getElementById(nameInput).value || navigator.platform || navigator.userAgent;
+        var response = await fetch('/api/webpush/subscribe', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        htmx.ajax('GET', '/htmx/webpush.html', { target: '#webpush-einstellungen', swap: 'outerHTML' });
+    } catch (e) {
+        status.textContent = e.message;
+        status.className = 'tag is-danger is-normal';
+    }
+}
@@ -1,101 +1,206 @@
 package main
 
 import (
+	"embed"
+	"encoding/json"
 	"errors"
 	"slices"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Tokens missing in a locale are taken from this one
+const FALLBACK_LANGUAGE = "en"
+
+//go:embed locales
+var localeFS embed.FS
+
 type Translation struct {
-	TokenMap           map[string][]string
-	CurrentLanguage    string
+	// language code -> token -> text
+	TokenMap map[string]map[string]string
+	// used when neither the browser nor the request asks for a supported language
+	DefaultLanguage    string
 	SupportedLanguages []string
-	currentIndex       int
 }
 
-// TODO: Load this from an embedded file
+// Loads every locales/<language code>.json, each a flat JSON object of token -> text
 func setupTranslation() *Translation {
 	trans := Translation{
-		TokenMap: make(map[string][]string),
-	}
-
-	trans.SupportedLanguages = []string{"de", "en"}
-	trans.CurrentLanguage = "en"
-	trans.currentIndex = 1
-
-	trans.TokenMap["header"] = []string{"Frigate Nachrichten Dienst", "Frigate Notification Service"}
-	trans.TokenMap["reload"] = []string{"Seite neuladen", "Reload page"}
-	trans.TokenMap["overview"] = []string{"Übersicht", "Overview"}
-	trans.TokenMap["menu"] = []string{"Menü", "Menu"}
-	trans.TokenMap["settings"] = []string{"Einstellungen", "Settings"}
-	trans.TokenMap["notifications"] = []string{"Benachrichtigungen", "Notifications"}
-	trans.TokenMap["last_notify"] = []string{"Letzte Benachrichtigungen", "Recent notifications"}
-	trans.TokenMap["cooldown"] = []string{"Abklingzeit (in Sek)", "Cooldown (in sec)"}
-	trans.TokenMap["active_cams"] = []string{"Aktive Kameras", "Active cameras"}
-	trans.TokenMap["apply"] = []string{"Übernehmen", "Apply"}
-	trans.TokenMap["active"] = []string{"Aktiv", "active"}
-	trans.TokenMap["tel_doc"] = []string{
-		` <ol>
-                <li>Zuerst beim <a href="https://telegram.me/BotFather">BotFather</a> einen neuen Bot erstellen</li>
-                <li>Dann den Bot in Telegram starten</li>
-                <li>Das Bot Token hier reinkopieren + aktiv anwählen und übernehmen</li>
-                <li>Dem Bot /getid schreiben und die Antwort hier in Chat ID reinkopieren und übernehmen</li>
-            </ol>`,
-		` <ol>
-                <li>Create a bot from <a href="https://telegram.me/BotFather">BotFather</a></li>
-                <li>Start the bot in telegram</li>
-                <li>Copy the bot token and add it here, press apply</li>
-                <li>Write /getid to the bot and copy the answer into Chat ID, press apply</li>
-            </ol>`,
-	}
-	trans.TokenMap["confID"] = []string{"Konfigurations ID", "Configuration ID"}
-	trans.TokenMap["apprise_doc"] = []string{
-		` <ol>
-                <li>Zu :7778 wechseln und eine neue Apprise Konfiguration erstellen</li>
-                <li>Eine Benachrichtigung in Apprise erstellen und testen</li>
-                <li>Die ID hier reinkopieren und übernehmen</li>
-            </ol>`,
-		` <ol>
-                <li>Go to :7778 (or whatever you configured in docker) and create a new Apprise configuration</li>
-                <li>Configure notifications in Apprise and test them</li>
-                <li>Paste the configuration ID here and apply</li>
-            </ol>`,
-	}
-	trans.TokenMap["camera"] = []string{"Kamera", "camera"}
-	trans.TokenMap["object"] = []string{"Objekt", "object"}
-	trans.TokenMap["test_notification"] = []string{"Benachrichtigung testen", "Test notification"}
+		TokenMap:        make(map[string]map[string]string),
+		DefaultLanguage: FALLBACK_LANGUAGE,
+	}
+
+	files, err := localeFS.ReadDir("locales")
+	if err != nil {
+		LogError("Locales could not be read: %v", err)
+		return &trans
+	}
+
+	for _, f := range files {
+		lang, isJson := strings.CutSuffix(f.Name(), ".json")
+		if !isJson {
+			continue
+		}
+
+		data, err := localeFS.ReadFile("locales/" + f.Name())
+		if err != nil {
+			LogError("Locale %s could not be read: %v", f.Name(), err)
+			continue
+		}
+
+		tokens := make(map[string]string)
+		err = json.Unmarshal(data, &tokens)
+		if err != nil {
+			LogError("Locale %s could not be parsed: %v", f.Name(), err)
+			continue
+		}
+
+		trans.TokenMap[lang] = tokens
+		trans.SupportedLanguages = append(trans.SupportedLanguages, lang)
+	}
+	slices.Sort(trans.SupportedLanguages)
+
+	for lang, missing := range trans.missingTokens() {
+		LogWarn("Locale %s is missing %d tokens, using %s for: %s",
+			lang, len(missing), FALLBACK_LANGUAGE, strings.Join(missing, ", "))
+	}
 
 	return &trans
 }
 
+// Returns the tokens of the fallback language each locale is missing, sorted
+func (trans *Translation) missingTokens() map[string][]string {
+	missing := make(map[string][]string)
+	for lang, tokens := range trans.TokenMap {
+		if lang == FALLBACK_LANGUAGE {
+			continue
+		}
+		for token := range trans.TokenMap[FALLBACK_LANGUAGE] {
+			if _, avail := tokens[token]; !avail {
+				missing[lang] = append(missing[lang], token)
+			}
+		}
+		slices.Sort(missing[lang])
+	}
+	return missing
+}
+
 func (trans *Translation) getLanguages() []string {
 	return trans.SupportedLanguages
 }
 
-func (trans *Translation) setLanguage(lang string) error {
-	if !slices.Contains(trans.SupportedLanguages, lang) {
+func (trans *Translation) isSupported(lang string) bool {
+	return slices.Contains(trans.SupportedLanguages, lang)
+}
+
+func (trans *Translation) setDefaultLanguage(lang string) error {
+	if !trans.isSupported(lang) {
 		return errors.New("Language not supported")
 	}
 
-	for i, v := range trans.SupportedLanguages {
-		if v == lang {
-			trans.currentIndex = i
-			break
+	trans.DefaultLanguage = lang
+	return nil
+}
+
+// Picks the language for a request: the explicitly chosen one if supported,
+// then the best supported match of the Accept-Language header, then the default.
+func (trans *Translation) negotiate(chosen string, acceptLanguage string) string {
+	if trans.isSupported(chosen) {
+		return chosen
+	}
+	for _, lang := range parseAcceptLanguage(acceptLanguage) {
+		if trans.isSupported(lang) {
+			return lang
+		}
+	}
+	return trans.DefaultLanguage
+}
+
+// Returns the primary language subtags of an Accept-Language header ("de-DE,en;q=0.8"),
+// ordered by their quality value. Tags with q=0 and the wildcard are left out.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var tags []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		tag, _, _ = strings.Cut(tag, "-")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			value, isQ := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if !isQ {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
 		}
+		tags = append(tags, weighted{lang: tag, q: q})
 	}
 
-	trans.CurrentLanguage = lang
-	return nil
+	// stable, so equally weighted tags keep the order of the browser
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	langs := make([]string, 0, len(tags))
+	for _, t := range tags {
+		langs = append(langs, t.lang)
+	}
+	return langs
+}
+
+// Looks up tokens in a fixed language, e.g. the one negotiated for a web request
+// or the one configured for a notification sink.
+// Missing tokens are returned as they are, so is everything by the zero Translator.
+type Translator struct {
+	trans *Translation
+	lang  string
+}
+
+// Unsupported languages fall back to the default language
+func (trans *Translation) translator(lang string) Translator {
+	if !trans.isSupported(lang) {
+		lang = trans.DefaultLanguage
+	}
+	return Translator{trans: trans, lang: lang}
+}
+
+func (tr Translator) language() string {
+	return tr.lang
 }
 
-func (trans *Translation) lookupToken(token string) string {
-	s, avail := trans.TokenMap[token]
-	if !avail {
-		return ""
+func (tr Translator) lookupToken(token string) string {
+	if tr.trans == nil {
+		return token
 	}
 
-	if len(s) < trans.currentIndex {
-		return ""
+	if s, avail := tr.trans.TokenMap[tr.lang][token]; avail {
+		return s
 	}
+	if s, avail := tr.trans.TokenMap[FALLBACK_LANGUAGE][token]; avail {
+		return s
+	}
+	return token
+}
 
-	return s[trans.currentIndex]
+// Translates Frigate labels like "person", unknown labels are kept
+func (tr Translator) label(label string) string {
+	token := "label_" + label
+	translated := tr.lookupToken(token)
+	if translated == token {
+		return label
+	}
+	return translated
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestTranslation() *Translation {
+	return &Translation{
+		TokenMap: map[string]map[string]string{
+			"en": {"apply": "Apply", "active": "Active", "label_person": "Person"},
+			"de": {"apply": "Übernehmen", "label_person": "Person (de)"},
+			"fr": {"apply": "Appliquer"},
+		},
+		DefaultLanguage:    "de",
+		SupportedLanguages: []string{"de", "en", "fr"},
+	}
+}
+
+func TestLookupToken(t *testing.T) {
+	trans := newTestTranslation()
+
+	tests := []struct {
+		name  string
+		tr    Translator
+		token string
+		want  string
+	}{
+		{name: "own language", tr: trans.translator("fr"), token: "apply", want: "Appliquer"},
+		{name: "missing in own language", tr: trans.translator("fr"), token: "active", want: "Active"},
+		{name: "missing everywhere", tr: trans.translator("fr"), token: "unknown", want: "unknown"},
+		{name: "fallback language", tr: trans.translator("en"), token: "active", want: "Active"},
+		{name: "unsupported language uses the default", tr: trans.translator("it"), token: "apply", want: "Übernehmen"},
+		{name: "empty language uses the default", tr: trans.translator(""), token: "apply", want: "Übernehmen"},
+		{name: "missing in the default", tr: trans.translator("it"), token: "active", want: "Active"},
+		{name: "zero Translator", tr: Translator{}, token: "apply", want: "apply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tr.lookupToken(tt.token); got != tt.want {
+				t.Errorf("lookupToken(%q) in %q = %q, want %q", tt.token, tt.tr.language(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslatorLabel(t *testing.T) {
+	trans := newTestTranslation()
+
+	tests := []struct {
+		lang  string
+		label string
+		want  string
+	}{
+		{lang: "de", label: "person", want: "Person (de)"},
+		{lang: "fr", label: "person", want: "Person"},
+		{lang: "fr", label: "raccoon", want: "raccoon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang+"/"+tt.label, func(t *testing.T) {
+			if got := trans.translator(tt.lang).label(tt.label); got != tt.want {
+				t.Errorf("label(%q) in %q = %q, want %q", tt.label, tt.lang, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingTokens(t *testing.T) {
+	want := map[string][]string{
+		"de": {"active"},
+		"fr": {"active", "label_person"},
+	}
+	if got := newTestTranslation().missingTokens(); !reflect.DeepEqual(got, want) {
+		t.Errorf("missingTokens = %v, want %v", got, want)
+	}
+}
+
+// Every shipped locale is complete, missing tokens would show up in English
+func TestLocalesComplete(t *testing.T) {
+	trans := setupTranslation()
+	if !trans.isSupported(FALLBACK_LANGUAGE) {
+		t.Fatalf("fallback language %s is not shipped", FALLBACK_LANGUAGE)
+	}
+	for lang, missing := range trans.missingTokens() {
+		if len(missing) > 0 {
+			t.Errorf("locale %s is missing %v", lang, missing)
+		}
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{header: "", want: []string{}},
+		{header: "de", want: []string{"de"}},
+		{header: "de-DE,de;q=0.9,en;q=0.8", want: []string{"de", "de", "en"}},
+		{header: "en;q=0.5, FR-ca;q=0.9, nl", want: []string{"nl", "fr", "en"}},
+		{header: "es;q=0.8,fr;q=0.8", want: []string{"es", "fr"}},
+		{header: "*, de;q=0", want: []string{}},
+		{header: "de;q=abc", want: []string{"de"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	trans := newTestTranslation()
+
+	tests := []struct {
+		name           string
+		chosen         string
+		acceptLanguage string
+		want           string
+	}{
+		{name: "chosen", chosen: "fr", acceptLanguage: "en", want: "fr"},
+		{name: "chosen unsupported", chosen: "it", acceptLanguage: "en", want: "en"},
+		{name: "best supported match", acceptLanguage: "it, fr;q=0.5, en;q=0.8", want: "en"},
+		{name: "region of a supported language", acceptLanguage: "fr-CH", want: "fr"},
+		{name: "nothing supported", acceptLanguage: "it, es", want: "de"},
+		{name: "nothing asked for", want: "de"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trans.negotiate(tt.chosen, tt.acceptLanguage); got != tt.want {
+				t.Errorf("negotiate(%q, %q) = %q, want %q", tt.chosen, tt.acceptLanguage, got, tt.want)
+			}
+		})
+	}
+}
@@ -7,8 +7,13 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,6 +21,10 @@ import (
 
 const MAX_NOTIFICATIONS = 3
 
+// Remembers the language chosen in the browser, the Accept-Language header is used without it
+const LANGUAGE_COOKIE = "fnd_language"
+const LANGUAGE_COOKIE_MAX_AGE = 365 * 24 * 60 * 60
+
 type FNDWebServer struct {
 	srv             *http.Server
 	r               *gin.Engine
@@ -24,6 +33,31 @@ type FNDWebServer struct {
 	frigateConf     *FNDFrigateConfiguration
 	translation     *Translation
 	frigateEvent    *FNDFrigateEventManager
+	history         *FNDHistoryStore
+
+	// name of the sink instance in copies made by addInstanceRouter
+	instance string
+	// routers of the additional sink instances by instance name, see serveHTTP
+	instanceRouters map[string]FNDSinkInstanceRouter
+	// guards instanceRouters and OverviewPayload.NotificationStatus, shared with the copies
+	m *sync.Mutex
+}
+
+type FNDSinkInstanceRouter struct {
+	typ string
+	r   *gin.Engine
+}
+
+type FNDSinkInstanceLink struct {
+	Name string
+	Type string
+	Page string
+}
+
+type SinkInstancesNavPayload struct {
+	Links []FNDSinkInstanceLink
+	// the settings page replaces the links in the navigation out of band
+	OOB bool
 }
 
 type FNDWebNotification struct {
@@ -35,6 +69,8 @@ type FNDNotificationSinkStatus struct {
 	Name    string
 	Good    bool
 	Message string
+	// notifications waiting for or in delivery, see notify_queue.go
+	Queued int
 }
 
 type OverviewPayload struct {
@@ -42,7 +78,9 @@ type OverviewPayload struct {
 	NotificationStatus map[string]FNDNotificationSinkStatus
 	Version            string
 	TranslatedText     []string
-	ActiveLanguage     int
+	ActiveLanguage     string
+	Languages          []string
+	SinkInstances      SinkInstancesNavPayload
 }
 
 type BenachrichtigungPayload struct {
@@ -50,6 +88,7 @@ type BenachrichtigungPayload struct {
 	Color          string
 	StatusMessage  string
 	Conf           *FNDFrigateConfiguration
+	Languages      []string
 	TranslatedText []string
 }
 
@@ -59,42 +98,33 @@ var templateFS embed.FS
 //go:embed static
 var staticFS embed.FS
 
-func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer {
+func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration, history *FNDHistoryStore) *FNDWebServer {
 	r := gin.Default()
 
 	var web FNDWebServer
 	web.srv = &http.Server{
 		Addr:    addr,
-		Handler: r,
+		Handler: http.HandlerFunc(web.serveHTTP),
 	}
+	web.instanceRouters = make(map[string]FNDSinkInstanceRouter)
+	web.m = &sync.Mutex{}
 	web.OverviewPayload.WebNotifications = make([]FNDWebNotification, MAX_NOTIFICATIONS)
 	web.OverviewPayload.NotificationStatus = make(map[string]FNDNotificationSinkStatus)
 	web.OverviewPayload.Version = version
 
 	web.frigateConf = conf
+	web.history = history
 	web.r = r
 	web.translation = setupTranslation()
-	web.translation.setLanguage(web.frigateConf.Language)
+	web.translation.setDefaultLanguage(web.frigateConf.Language)
 
 	r.GET("/", func(c *gin.Context) {
-
-		web.OverviewPayload.ActiveLanguage = web.translation.currentIndex
-
-		web.OverviewPayload.TranslatedText = []string{
-			web.translation.lookupToken("header"),
-			web.translation.lookupToken("overview"),
-			web.translation.lookupToken("menu"),
-			web.translation.lookupToken("settings"),
-			web.translation.lookupToken("notifications"),
-			web.translation.lookupToken("last_notify"),
-			web.translation.lookupToken("test_notification"),
-		}
-
 		t := template.Must(template.ParseFS(templateFS,
 			"templates/index.html",
 			"templates/uebersicht.html",
-			"templates/navigation.html"))
-		t.Execute(c.Writer, web.OverviewPayload)
+			"templates/navigation.html",
+			"templates/sink_instances.html"))
+		t.Execute(c.Writer, web.generateOverviewPayload(web.translatorFor(c)))
 	})
 
 	r.GET("/static/htmx.min.js", func(c *gin.Context) {
@@ -109,7 +139,7 @@ func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer
 
 	r.GET("/htmx/uebersicht.html", func(c *gin.Context) {
 		t := template.Must(template.ParseFS(templateFS, "templates/uebersicht.html"))
-		t.Execute(c.Writer, web.OverviewPayload)
+		t.Execute(c.Writer, web.generateOverviewPayload(web.translatorFor(c)))
 	})
 	r.GET("/htmx/frigate.html", func(c *gin.Context) {
 		t := template.Must(template.ParseFS(templateFS, "templates/frigate.html"))
@@ -123,33 +153,26 @@ func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer
 		t.Execute(c.Writer, nil)
 	})
 	r.GET("/htmx/benachrichtigungen.html", func(c *gin.Context) {
-
-		text := []string{
-			web.translation.lookupToken("notifications"),
-			web.translation.lookupToken("cooldown"),
-			web.translation.lookupToken("active_cams"),
-			web.translation.lookupToken("apply"),
-		}
-
 		t := template.Must(template.ParseFS(templateFS, "templates/benachrichtigungen.html"))
-		t.Execute(c.Writer, BenachrichtigungPayload{
-			ShowStatus:     false,
-			Conf:           conf,
-			TranslatedText: text,
-		})
+		t.Execute(c.Writer, web.generateBenachrichtigungPayload(web.translatorFor(c)))
 	})
 
+	r.GET("/api/translations/missing", func(c *gin.Context) {
+		c.JSON(http.StatusOK, web.translation.missingTokens())
+	})
+
+	// Only changes the language of this browser, see translatorFor
 	r.POST("/htmx/language.html", func(c *gin.Context) {
 
 		lang := c.Query("lang")
 		var payload string
 
-		err := web.translation.setLanguage(lang)
-		if err != nil {
-			payload = err.Error()
+		if !web.translation.isSupported(lang) {
+			payload = "Language not supported"
 		} else {
-			payload = web.translation.lookupToken("reload")
-			web.frigateConf.Language = lang
+			c.SetSameSite(http.SameSiteLaxMode)
+			c.SetCookie(LANGUAGE_COOKIE, lang, LANGUAGE_COOKIE_MAX_AGE, "/", "", false, true)
+			payload = web.translation.translator(lang).lookupToken("reload")
 		}
 
 		t := template.Must(template.ParseFS(templateFS, "templates/language.html"))
@@ -157,13 +180,6 @@ func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer
 	})
 	r.POST("/htmx/benachrichtigungen.html", func(c *gin.Context) {
 
-		text := []string{
-			web.translation.lookupToken("notifications"),
-			web.translation.lookupToken("cooldown"),
-			web.translation.lookupToken("active_cams"),
-			web.translation.lookupToken("apply"),
-		}
-
 		var onList []string
 		c.MultipartForm()
 		for key, value := range c.Request.PostForm {
@@ -177,6 +193,12 @@ func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer
 				}
 				continue
 			}
+			if key == "language0815" {
+				if web.translation.setDefaultLanguage(value[0]) == nil {
+					conf.Language = value[0]
+				}
+				continue
+			}
 			if value[0] == "on" {
 				onList = append(onList, key)
 			}
@@ -184,19 +206,68 @@ func setupBasicRoutes(addr string, conf *FNDFrigateConfiguration) *FNDWebServer
 
 		conf.activateCameras(onList)
 
+		pay := web.generateBenachrichtigungPayload(web.translatorFor(c))
+		pay.ShowStatus = true
+		pay.Color = "is-primary"
+		pay.StatusMessage = "OK"
+
 		t := template.Must(template.ParseFS(templateFS, "templates/benachrichtigungen.html"))
-		t.Execute(c.Writer, BenachrichtigungPayload{
-			ShowStatus:     true,
-			Color:          "is-primary",
-			StatusMessage:  "OK",
-			Conf:           conf,
-			TranslatedText: text,
-		})
+		t.Execute(c.Writer, pay)
 	})
 
+	registerCaptionRoutes(&web)
+	history.registerWebServer(&web)
+
 	return &web
 }
 
+// Returns the translator for the language of the requesting browser: the language chosen
+// with the language buttons, then Accept-Language, then the configured default language.
+func (web *FNDWebServer) translatorFor(c *gin.Context) Translator {
+	chosen, _ := c.Cookie(LANGUAGE_COOKIE)
+	return web.translation.translator(web.translation.negotiate(chosen, c.GetHeader("Accept-Language")))
+}
+
+// The overview is shared by everyone, only the texts are per request
+func (web *FNDWebServer) generateOverviewPayload(tr Translator) OverviewPayload {
+	web.m.Lock()
+	pay := web.OverviewPayload
+	pay.NotificationStatus = maps.Clone(web.OverviewPayload.NotificationStatus)
+	web.m.Unlock()
+	pay.SinkInstances = SinkInstancesNavPayload{Links: web.sinkInstanceLinks()}
+	pay.ActiveLanguage = tr.language()
+	pay.Languages = web.translation.getLanguages()
+	pay.TranslatedText = []string{
+		tr.lookupToken("header"),
+		tr.lookupToken("overview"),
+		tr.lookupToken("menu"),
+		tr.lookupToken("settings"),
+		tr.lookupToken("notifications"),
+		tr.lookupToken("last_notify"),
+		tr.lookupToken("test_notification"),
+		tr.lookupToken("history"),
+		tr.lookupToken("captions"),
+		tr.lookupToken("sink_instances"),
+		tr.lookupToken("routing"),
+		tr.lookupToken("outbox"),
+	}
+	return pay
+}
+
+func (web *FNDWebServer) generateBenachrichtigungPayload(tr Translator) BenachrichtigungPayload {
+	return BenachrichtigungPayload{
+		Conf:      web.frigateConf,
+		Languages: web.translation.getLanguages(),
+		TranslatedText: []string{
+			tr.lookupToken("notifications"),
+			tr.lookupToken("cooldown"),
+			tr.lookupToken("active_cams"),
+			tr.lookupToken("apply"),
+			tr.lookupToken("default_language"),
+		},
+	}
+}
+
 func (web *FNDWebServer) run(frigateEvent *FNDFrigateEventManager) {
 	web.frigateEvent = frigateEvent
 	if err := web.srv.ListenAndServe(); err != nil {
@@ -226,24 +297,112 @@ func (web *FNDWebServer) addNotification(n FNDNotification) {
 }
 
 func (web *FNDWebServer) addNotificationSinkStatus(n FNDNotificationSinkStatus) {
+	web.m.Lock()
+	defer web.m.Unlock()
 	web.OverviewPayload.NotificationStatus[n.Name] = n
 }
 
+func (web *FNDWebServer) removeNotificationSinkStatus(name string) {
+	web.m.Lock()
+	defer web.m.Unlock()
+	delete(web.OverviewPayload.NotificationStatus, name)
+}
+
+// Requests for the pages of additional sink instances carry the instance name,
+// in the query of the navigation links and as form field of the settings forms.
+// Everything else goes to the routes of web.r.
+func (web *FNDWebServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, "/htmx/") {
+		if name := req.FormValue("instance"); name != "" {
+			web.m.Lock()
+			router, ok := web.instanceRouters[name]
+			web.m.Unlock()
+			if !ok {
+				// never fall back to the first instance, the form would change its settings
+				http.Error(w, "Unknown sink instance: "+name, http.StatusNotFound)
+				return
+			}
+			router.r.ServeHTTP(w, req)
+			return
+		}
+	}
+	web.r.ServeHTTP(w, req)
+}
+
+// Web server for an additional sink instance. It shares everything with web,
+// but the sink registers its routes on a router of its own, see serveHTTP.
+func (web *FNDWebServer) addInstanceRouter(name, typ string) *FNDWebServer {
+	inst := *web
+	inst.instance = name
+	inst.r = gin.Default()
+
+	web.m.Lock()
+	defer web.m.Unlock()
+	web.instanceRouters[name] = FNDSinkInstanceRouter{typ: typ, r: inst.r}
+	return &inst
+}
+
+func (web *FNDWebServer) removeInstanceRouter(name string) {
+	web.m.Lock()
+	defer web.m.Unlock()
+	delete(web.instanceRouters, name)
+}
+
+// Links to the settings pages of the additional sink instances, sorted by name
+func (web *FNDWebServer) sinkInstanceLinks() []FNDSinkInstanceLink {
+	web.m.Lock()
+	defer web.m.Unlock()
+
+	links := make([]FNDSinkInstanceLink, 0, len(web.instanceRouters))
+	for name, router := range web.instanceRouters {
+		links = append(links, FNDSinkInstanceLink{
+			Name: name,
+			Type: router.typ,
+			Page: "/htmx/" + strings.ToLower(router.typ) + ".html?instance=" + url.QueryEscape(name),
+		})
+	}
+	slices.SortFunc(links, func(a, b FNDSinkInstanceLink) int { return strings.Compare(a.Name, b.Name) })
+	return links
+}
+
+// The sample event shows off the configured caption templates
+func (web *FNDWebServer) testNotification() (FNDNotification, error) {
+	data, err := staticFS.ReadFile("static/test_notification.jpg")
+	if err != nil {
+		return FNDNotification{}, err
+	}
+
+	// links and history entry share the ID
+	ev := sampleFNDNotificationEventWithID(web.frigateConf, "test-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	n := web.frigateConf.newNotification(ev)
+	n.JpegData = data
+	return n, nil
+}
+
 func (web *FNDWebServer) sendTestNotification() {
 	if web.frigateEvent == nil {
 		fmt.Println("ASSERTION failed: FrigateEventManager is nil")
 		return
 	}
 
-	data, err := staticFS.ReadFile("static/test_notification.jpg")
+	n, err := web.testNotification()
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 
-	web.frigateEvent.sendNotification(FNDNotification{
-		JpegData: data,
-		Date:     time.Now().Format("15:04:05 02.01.2006"),
-		Caption:  "Test",
+	web.history.addEntry(FNDHistoryEntry{
+		ID:       n.ID,
+		Camera:   n.Event.Camera,
+		Label:    n.Event.Label,
+		Score:    n.Event.Score,
+		Time:     n.Event.Time,
+		Decision: DECISION_TEST,
 	})
+	err = web.history.saveSnapshot(n.ID, n.JpegData)
+	if err != nil {
+		LogWarn("Could not save snapshot of %s: %v", n.ID, err)
+	}
+
+	web.frigateEvent.sendNotification(n)
 }